@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type blackout struct {
+	ID         int64  `json:"id"`
+	ProviderID int64  `json:"provider_id"`
+	Date       string `json:"date" schema:"date"`
+	Reason     string `json:"reason" schema:"reason"`
+}
+
+// maxShiftDays is how far after a blackout a working day is looked for
+const maxShiftDays = 31
+
+var errNoWorkingDay = errors.New("No working day with time slots within " + strconv.Itoa(maxShiftDays) + " days")
+
+type shiftedOrder struct {
+	OrderID int64  `json:"order_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// POST /api/provider/:id/blackouts
+func createNewBlackout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	providerID, _ := strconv.Atoi(ps.ByName("id"))
+	b := blackout{}
+	if err := ReadRequestBody(r, &b); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", b.Date); err != nil {
+		http.Error(w, "Invalid date", 400)
+		return
+	}
+
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(providers) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	query := `INSERT INTO provider_blackouts(provider_id, blackout_date, reason) VALUES($1, $2, $3) RETURNING id`
+	var id int64
+	err = dbConn.QueryRow(query, providerID, b.Date, b.Reason).Scan(&id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string]int64{"id": id})
+}
+
+// GET /api/provider/:id/blackouts
+func getBlackoutsByProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	providerID, _ := strconv.Atoi(ps.ByName("id"))
+
+	query := `
+		SELECT id, provider_id, to_char(blackout_date, 'YYYY-MM-DD'), reason
+		FROM provider_blackouts WHERE provider_id = $1 AND NOT deleted ORDER BY blackout_date ASC
+	`
+	blackouts, err := fetchBlackouts(query, providerID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string][]*blackout{"blackouts": blackouts})
+}
+
+// DELETE /api/provider/:id/blackouts/:blackout_id
+func deleteBlackout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	providerID, _ := strconv.Atoi(ps.ByName("id"))
+	ID, _ := strconv.Atoi(ps.ByName("blackout_id"))
+
+	query := `UPDATE provider_blackouts SET deleted = TRUE WHERE id = $1 AND provider_id = $2`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res, err := stmt.Exec(ID, providerID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if rowsAffected <= 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	RenderJSON(w, map[string]string{})
+}
+
+// POST /api/provider/:id/blackouts/shift
+// move every upcoming order falling on a blackout to the next working day.
+// Choices are cleared as slots and capacity depend on the date, and reminders re-timed.
+// Locked and escalated orders are reopened, see moveOrderDeliveryDate, and listed in "reopened".
+// Nothing is moved when an order has no working day to go to.
+func shiftOrdersOffBlackouts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	providerID, _ := strconv.Atoi(ps.ByName("id"))
+
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(providers) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	p := providers[0]
+	today := time.Now().In(p.location()).Format("2006-01-02")
+
+	blackouts, err := fetchBlackouts(`
+		SELECT id, provider_id, to_char(blackout_date, 'YYYY-MM-DD'), reason
+		FROM provider_blackouts WHERE provider_id = $1 AND blackout_date >= $2 AND NOT deleted`,
+		providerID, today,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	blackoutDates := map[string]bool{}
+	for _, b := range blackouts {
+		blackoutDates[b.Date] = true
+	}
+
+	orders, err := fetchOrders(`
+		SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale
+		FROM orders WHERE provider_id = $1 AND NOT deleted AND delivery_date IN (
+			SELECT blackout_date FROM provider_blackouts WHERE provider_id = $1 AND blackout_date >= $2 AND NOT deleted
+		)`,
+		providerID, today,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	shifted := []*shiftedOrder{}
+	for _, o := range orders {
+		nextDate, err := nextWorkingDay(o.ProviderID, o.DeliveryDate, blackoutDates)
+		if err == errNoWorkingDay {
+			http.Error(w, err.Error()+" after "+o.DeliveryDate, 409)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		shifted = append(shifted, &shiftedOrder{OrderID: o.ID, From: o.DeliveryDate, To: nextDate})
+	}
+
+	reopened := []int64{}
+	for i, o := range orders {
+		wasReopened, err := moveOrderDeliveryDate(o, shifted[i].To)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if wasReopened {
+			reopened = append(reopened, o.ID)
+		}
+
+		o.Provider = p
+		if err := scheduleReminder(o); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	RenderJSON(w, map[string]interface{}{"shifted": shifted, "reopened": reopened})
+}
+
+// isBlackoutDate report whether a provider does not deliver on date ('YYYY-MM-DD')
+func isBlackoutDate(providerID int64, date string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM provider_blackouts WHERE provider_id = $1 AND blackout_date = $2 AND NOT deleted)`
+	var found bool
+	err := dbConn.QueryRow(query, providerID, date).Scan(&found)
+	return found, err
+}
+
+// nextWorkingDay return the first date after date ('YYYY-MM-DD') that is not a blackout
+// and has time slots of the provider, errNoWorkingDay when none is within maxShiftDays
+func nextWorkingDay(providerID int64, date string, blackoutDates map[string]bool) (string, error) {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < maxShiftDays; i++ {
+		d = d.AddDate(0, 0, 1)
+		next := d.Format("2006-01-02")
+		if blackoutDates[next] {
+			continue
+		}
+		slots, err := fetchTimeSlotsForDate(dbConn, providerID, next, 0)
+		if err != nil {
+			return "", err
+		}
+		if len(slots) > 0 {
+			return next, nil
+		}
+	}
+	return "", errNoWorkingDay
+}
+
+// moveOrderDeliveryDate change the delivery date of an order and clear its choices,
+// so that the customer is asked to choose again.
+// Locked and escalated orders are reopened with their retries reset, reopened tells so,
+// as nobody would ask them otherwise. Other conversations that are not about choosing
+// slots, e.g. a requested cancellation, keep their state.
+// o is updated with the new date, state and retries.
+func moveOrderDeliveryDate(o *order, date string) (reopened bool, err error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE orders SET delivery_date = $1,
+		retries_count = CASE WHEN old.conversation_state IN ($2, $3, $4, $5) THEN 0 ELSE old.retries_count END,
+		conversation_state = CASE WHEN old.conversation_state IN ($2, $3, $4, $5) THEN $2 ELSE old.conversation_state END
+		FROM (SELECT id, retries_count, conversation_state FROM orders WHERE id = $6 FOR UPDATE) old
+		WHERE orders.id = old.id
+		RETURNING orders.retries_count, orders.conversation_state, old.conversation_state IN ($4, $5)
+	`
+	err = tx.QueryRow(query, date, stateAwaitingChoice, stateConfirmed, stateLocked, stateEscalated, o.ID).Scan(&o.RetriesCount, &o.ConversationState, &reopened)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE choices SET deleted = TRUE WHERE order_id = $1`, o.ID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	o.DeliveryDate = date
+	return reopened, nil
+}
+
+func fetchBlackouts(query string, args ...interface{}) ([]*blackout, error) {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*blackout, 0)
+	for rows.Next() {
+		b := new(blackout)
+		err = rows.Scan(&b.ID, &b.ProviderID, &b.Date, &b.Reason)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, b)
+	}
+
+	return results, nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"net/http"
 	"strconv"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
 )
 
 type choice struct {
@@ -22,7 +24,7 @@ func createNewChoice(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	slots, err := fetchTimeSlots(`SELECT id, start_time, end_time, provider_id FROM time_slots WHERE id = $1 AND NOT deleted`, c.TimeSlotID)
+	slots, err := fetchTimeSlots(`SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE id = $1 AND NOT deleted`, c.TimeSlotID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -32,7 +34,7 @@ func createNewChoice(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE id = $1 AND NOT deleted`, c.OrderID)
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, c.OrderID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -41,15 +43,40 @@ func createNewChoice(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		http.Error(w, "Invalid order", 400)
 		return
 	}
+	if slots[0].ProviderID != orders[0].ProviderID {
+		http.Error(w, "Invalid slot", 400)
+		return
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+
+	available, err := lockTimeSlotsForDate(tx, orders[0], []int64{c.TimeSlotID})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(available) == 0 {
+		http.Error(w, "Time slot is full or not offered on the delivery date", 409)
+		return
+	}
 
 	query := `INSERT INTO choices(time_slot_id, order_id) VALUES($1, $2) RETURNING time_slot_id, order_id`
 	var timeSlotID int64
 	var orderID int64
-	err = dbConn.QueryRow(query, c.TimeSlotID, c.OrderID).Scan(&timeSlotID, &orderID)
+	err = tx.QueryRow(query, c.TimeSlotID, c.OrderID).Scan(&timeSlotID, &orderID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	RenderJSON(w, map[string]int64{"time_slot_id": timeSlotID, "order_id": orderID})
 }
@@ -100,6 +127,65 @@ func deleteChoice(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	RenderJSON(w, map[string]string{})
 }
 
+// replaceChoices swap the choices of an order for the given slots that still have room
+// on its delivery date and return the slots saved.
+// Previous choices are kept if none of the slots has room.
+func replaceChoices(o *order, slots []*timeSlot) ([]*timeSlot, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	slotIDs := []int64{}
+	for _, s := range slots {
+		slotIDs = append(slotIDs, s.ID)
+	}
+	saved, err := lockTimeSlotsForDate(tx, o, slotIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved) == 0 {
+		return saved, nil
+	}
+
+	// clear all previously made choices
+	if _, err := tx.Exec(`UPDATE choices SET deleted = TRUE WHERE order_id = $1`, o.ID); err != nil {
+		return nil, err
+	}
+	for _, s := range saved {
+		if _, err := tx.Exec(`INSERT INTO choices(time_slot_id, order_id) VALUES($1, $2)`, s.ID, o.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return saved, tx.Commit()
+}
+
+// lockTimeSlotsForDate lock the given slots until tx ends, so that concurrent choices
+// cannot overbook them, and return the ones with room left on the delivery date of o
+func lockTimeSlotsForDate(tx *sql.Tx, o *order, slotIDs []int64) ([]*timeSlot, error) {
+	if _, err := tx.Exec(`SELECT id FROM time_slots WHERE id = ANY($1) ORDER BY id FOR UPDATE`, pq.Array(slotIDs)); err != nil {
+		return nil, err
+	}
+
+	slots, err := fetchTimeSlotsForDate(tx, o.ProviderID, o.DeliveryDate, o.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	available := []*timeSlot{}
+	for _, s := range slots {
+		for _, id := range slotIDs {
+			if s.ID == id && !s.isFull() {
+				available = append(available, s)
+			}
+		}
+	}
+
+	return available, nil
+}
+
 func fetchChoices(query string, args ...interface{}) ([]*choice, error) {
 	rows, err := dbConn.Query(query, args...)
 	if err != nil {
@@ -115,13 +201,13 @@ func fetchChoices(query string, args ...interface{}) ([]*choice, error) {
 			return nil, err
 		}
 
-		slots, err := fetchTimeSlots(`SELECT id, start_time, end_time, provider_id FROM time_slots WHERE id = $1 AND NOT deleted`, c.TimeSlotID)
+		slots, err := fetchTimeSlots(`SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE id = $1 AND NOT deleted`, c.TimeSlotID)
 		if err != nil {
 			return nil, err
 		}
 		c.TimeSlot = slots[0]
 
-		orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE id = $1 AND NOT deleted`, c.OrderID)
+		orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, c.OrderID)
 		if err != nil {
 			return nil, err
 		}
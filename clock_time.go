@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockTime is a wall clock time of day with minute precision,
+// stored as TIME and rendered as "HH:MM" everywhere
+type clockTime struct {
+	Hour   int
+	Minute int
+}
+
+// parseClockTime accept "HH:MM" or "HH:MM:SS" with seconds ignored
+func parseClockTime(str string) (clockTime, error) {
+	str = strings.TrimSpace(str)
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return clockTime{Hour: t.Hour(), Minute: t.Minute()}, nil
+		}
+	}
+	return clockTime{}, errors.New("Invalid time " + str + ", expected HH:MM")
+}
+
+func (c clockTime) String() string {
+	return fmt.Sprintf("%02d:%02d", c.Hour, c.Minute)
+}
+
+// minutes since midnight
+func (c clockTime) minutes() int {
+	return c.Hour*60 + c.Minute
+}
+
+// Before report whether c is earlier in the day than other
+func (c clockTime) Before(other clockTime) bool {
+	return c.minutes() < other.minutes()
+}
+
+// Scan implement sql.Scanner for TIME columns
+func (c *clockTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return c.UnmarshalText(v)
+	case string:
+		return c.UnmarshalText([]byte(v))
+	case time.Time:
+		*c = clockTime{Hour: v.Hour(), Minute: v.Minute()}
+		return nil
+	}
+	return fmt.Errorf("Cannot scan %T into clockTime", src)
+}
+
+// Value implement driver.Valuer
+func (c clockTime) Value() (driver.Value, error) {
+	return c.String(), nil
+}
+
+// UnmarshalText implement encoding.TextUnmarshaler, used by form decoding
+func (c *clockTime) UnmarshalText(text []byte) error {
+	parsed, err := parseClockTime(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// MarshalJSON implement json.Marshaler
+func (c clockTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// UnmarshalJSON implement json.Unmarshaler
+func (c *clockTime) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	return c.UnmarshalText([]byte(str))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"time"
+)
+
+// states of the sms conversation with the customer of an order
+const (
+	stateAwaitingChoice     = "awaiting_choice"
+	stateConfirmed          = "confirmed"
+	stateAwaitingCorrection = "awaiting_correction"
+	stateLocked             = "locked"
+	stateEscalated          = "escalated"
+	stateCancelRequested    = "cancel_requested"
+)
+
+// what an inbound sms is asking for
+const (
+	intentChoice = "choice"
+	intentWrong  = "wrong"
+	intentHelp   = "help"
+	intentStatus = "status"
+	intentCancel = "cancel"
+	intentStop   = "stop"
+	intentStart  = "start"
+)
+
+// maxRetries is how many times a customer can choose slots before the order is locked
+const maxRetries = 3
+
+// unremindedStates are conversations a reminder must not reopen: the customer
+// asked to cancel, ran out of choices, or was handed over to the provider
+var unremindedStates = map[string]bool{
+	stateCancelRequested: true,
+	stateLocked:          true,
+	stateEscalated:       true,
+}
+
+// replyHandler act on an inbound sms for an order.
+// order must have Provider populated.
+type replyHandler func(o *order, s *sms) error
+
+// conversationTransitions decide, from the state of the conversation,
+// what is done with each kind of reply
+var conversationTransitions = map[string]map[string]replyHandler{
+	stateAwaitingChoice: {
+		intentChoice: chooseSlots,
+		intentWrong:  resendSlotMenu,
+		intentCancel: requestCancellation,
+	},
+	stateConfirmed: {
+		intentChoice: chooseSlots,
+		intentWrong:  startCorrection,
+		intentCancel: requestCancellation,
+	},
+	stateAwaitingCorrection: {
+		intentChoice: chooseSlots,
+		intentWrong:  resendSlotMenu,
+		intentCancel: requestCancellation,
+	},
+	stateLocked: {
+		intentChoice: escalate,
+		intentWrong:  escalate,
+		intentCancel: requestCancellation,
+	},
+	stateEscalated: {
+		intentChoice: remindLocked,
+		intentWrong:  remindLocked,
+		intentCancel: requestCancellation,
+	},
+	stateCancelRequested: {
+		intentChoice: remindCancelRequested,
+		intentWrong:  remindCancelRequested,
+		intentCancel: remindCancelRequested,
+	},
+}
+
+// keywordHandlers answer keywords the same way whatever the state of the conversation,
+// even once the delivery is over
+var keywordHandlers = map[string]replyHandler{
+	intentHelp:   sendHelp,
+	intentStatus: sendStatus,
+	intentStop:   stopMessages,
+	intentStart:  resumeMessages,
+}
+
+// handleReply run the transition for an inbound sms.
+// Replies about deliveries already past are answered without touching the conversation.
+// order must have Provider populated.
+func handleReply(o *order, s *sms, intent string) error {
+	if handler, ok := keywordHandlers[intent]; ok {
+		return handler(o, s)
+	}
+
+	past, err := isPastDelivery(o)
+	if err != nil {
+		return err
+	}
+	if past {
+		_, err := sendPastDeliverySms(o)
+		return err
+	}
+
+	transitions, ok := conversationTransitions[o.ConversationState]
+	if !ok {
+		transitions = conversationTransitions[stateAwaitingChoice]
+	}
+	return transitions[intent](o, s)
+}
+
+// chooseSlots save the slots a customer replied with and confirm them.
+// The order is locked once maxRetries choices were made.
+func chooseSlots(o *order, s *sms) error {
+	slots, err := fetchTimeSlotsForDate(dbConn, o.ProviderID, o.DeliveryDate, o.ID)
+	if err != nil {
+		return err
+	}
+	o.Provider.Slots = slots
+
+	// resolve numbers against the menu the customer was sent, falling back
+	// to the current slots for orders reminded before menus were kept
+	menu := slots
+	slotMenu, err := latestSlotMenu(o.ID)
+	if err != nil {
+		return err
+	}
+	if slotMenu != nil {
+		menu = []*timeSlot{}
+		for _, id := range slotMenu {
+			var menuSlot *timeSlot
+			for _, slot := range slots {
+				if slot.ID == id {
+					menuSlot = slot
+				}
+			}
+			menu = append(menu, menuSlot)
+		}
+	}
+
+	chosenNumbers, err := parseSlotReply(s.Body, len(menu))
+	if err != nil {
+		reason := err.Error()
+		if replyErr, ok := err.(*slotReplyError); ok {
+			reason = replyErr.localized(o.locale())
+		}
+		_, err := sendInvalidReplySms(o, reason)
+		return err
+	}
+	// slots removed since the menu was sent are treated as full
+	chosen := []*timeSlot{}
+	for _, n := range chosenNumbers {
+		if menu[n-1] != nil {
+			chosen = append(chosen, menu[n-1])
+		}
+	}
+
+	saved, err := replaceChoices(o, chosen)
+	if err != nil {
+		return err
+	}
+	if len(saved) == 0 {
+		_, err := sendSlotsFullSms(o)
+		return err
+	}
+	for _, slot := range saved {
+		o.Choices = append(o.Choices, &choice{TimeSlot: slot})
+	}
+
+	query := `
+		UPDATE orders SET retries_count = retries_count + 1,
+		conversation_state = CASE WHEN retries_count + 1 >= $2 THEN $3 ELSE $4 END
+		WHERE id = $1 RETURNING retries_count, conversation_state
+	`
+	err = dbConn.QueryRow(query, o.ID, maxRetries, stateLocked, stateConfirmed).Scan(&o.RetriesCount, &o.ConversationState)
+	if err != nil {
+		return err
+	}
+
+	_, err = sendConfirmationSms(o)
+	return err
+}
+
+// resendSlotMenu send the slots again without changing the conversation,
+// e.g. on WRONG before any choice was made
+func resendSlotMenu(o *order, s *sms) error {
+	slots, err := fetchTimeSlotsForDate(dbConn, o.ProviderID, o.DeliveryDate, o.ID)
+	if err != nil {
+		return err
+	}
+	o.Provider.Slots = slots
+
+	_, err = sendRetrySms(o, o.RetriesCount == maxRetries-1)
+	return err
+}
+
+// startCorrection let a customer change confirmed slots while changes are left
+func startCorrection(o *order, s *sms) error {
+	if o.RetriesCount >= maxRetries {
+		return escalate(o, s)
+	}
+
+	if err := setConversationState(o, stateAwaitingCorrection); err != nil {
+		return err
+	}
+	return resendSlotMenu(o, s)
+}
+
+// escalate hand a locked conversation over to the provider
+func escalate(o *order, s *sms) error {
+	if err := setConversationState(o, stateEscalated); err != nil {
+		return err
+	}
+	return remindLocked(o, s)
+}
+
+// remindLocked tell the customer no more changes can be made by sms
+func remindLocked(o *order, s *sms) error {
+	_, err := sendMaxExceededSms(o)
+	return err
+}
+
+// requestCancellation flag the order for the provider to follow up.
+// No more reminders are sent for it.
+func requestCancellation(o *order, s *sms) error {
+	if err := setConversationState(o, stateCancelRequested); err != nil {
+		return err
+	}
+	if err := cancelReminderJobs(o.ID); err != nil {
+		return err
+	}
+	_, err := sendCancelRequestedSms(o)
+	return err
+}
+
+// remindCancelRequested tell the customer the provider is looking at the cancellation
+func remindCancelRequested(o *order, s *sms) error {
+	_, err := sendCancelRequestedSms(o)
+	return err
+}
+
+// sendHelp tell the customer what can be replied and who to call
+func sendHelp(o *order, s *sms) error {
+	_, err := sendHelpSms(o)
+	return err
+}
+
+// sendStatus tell the customer the delivery date and the slots chosen so far
+func sendStatus(o *order, s *sms) error {
+	query := `SELECT time_slot_id, order_id FROM choices WHERE order_id = $1 AND NOT deleted`
+	choices, err := fetchChoices(query, o.ID)
+	if err != nil {
+		return err
+	}
+	o.Choices = choices
+
+	_, err = sendStatusSms(o)
+	return err
+}
+
+// stopMessages stop texting the customer about any order, whichever the provider.
+// Opting out of a single provider is left to the opt out API.
+// The acknowledgement is the last message sent, bar answers to later messages of the customer.
+func stopMessages(o *order, s *sms) error {
+	if _, err := sendOptOutSms(o); err != nil {
+		return err
+	}
+	return addOptOut(o.ContactNumber, nil, optOutSourceSms)
+}
+
+// resumeMessages text the customer again, lifting opt outs from the provider and from everything
+func resumeMessages(o *order, s *sms) error {
+	if err := removeOptOuts(o.ContactNumber, &o.ProviderID); err != nil {
+		return err
+	}
+	_, err := sendOptInSms(o)
+	return err
+}
+
+// optOutUnknownNumber apply STOP and START from a number without any order
+// to every provider, using the default keywords of every locale
+func optOutUnknownNumber(s *sms) error {
+	switch localeKeywords(nil).intentOf(s.Body, "") {
+	case intentStop:
+		return addOptOut(s.From, nil, optOutSourceSms)
+	case intentStart:
+		return removeOptOuts(s.From, nil)
+	}
+	return nil
+}
+
+func setConversationState(o *order, state string) error {
+	query := `UPDATE orders SET conversation_state = $1 WHERE id = $2`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	if _, err := stmt.Exec(state, o.ID); err != nil {
+		return err
+	}
+	o.ConversationState = state
+	return nil
+}
+
+// isPastDelivery report whether the delivery day of an order is over
+// in the timezone of its provider.
+// order must have Provider populated.
+func isPastDelivery(o *order) (bool, error) {
+	deliveryDate, err := generateGoDateFromString(o.DeliveryDate, "0", o.Provider.location())
+	if err != nil {
+		return false, err
+	}
+	return !time.Now().Before(deliveryDate.AddDate(0, 0, 1)), nil
+}
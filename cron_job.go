@@ -2,41 +2,122 @@ package main
 
 import (
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-
-	"github.com/luca-moser/chronos"
 )
 
+// reminderPollInterval is how often the worker looks for due reminders
+const reminderPollInterval = 30 * time.Second
+
+// initCron run the reminder worker until stopSignal fires
 func initCron(stopSignal <-chan int) {
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE NOT deleted`)
+	catchUpMissedReminders()
+
+	ticker := time.NewTicker(reminderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		processDueReminderJobs()
+
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runReminderJob send the reminder sms of a claimed job
+// and return the status the job should end up in
+func runReminderJob(j *reminderJob) (string, error) {
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, j.OrderID)
 	if err != nil {
-		log.Fatal("Failed to query for all orders to initiate cron job:", err.Error())
-		return
+		return "", err
 	}
+	if len(orders) == 0 || unremindedStates[orders[0].ConversationState] {
+		return jobStatusCancelled, nil
+	}
+	o := orders[0]
 
-	for _, o := range orders {
-		p, err := fetchProviders(`
-			SELECT id, title, contact_number, EXTRACT(HOUR FROM timezone('UTC', reminder_time))
-			FROM providers WHERE id = $1 AND NOT deleted LIMIT 1`,
-			o.ProviderID,
-		)
-		if err != nil {
-			log.Fatal("Failed to get provider for order", o.ID, ":", err.Error())
-			return
+	providers, err := fetchProviders(`
+		SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale
+		FROM providers WHERE id = $1 AND NOT deleted`,
+		o.ProviderID,
+	)
+	if err != nil {
+		return "", err
+	}
+	if len(providers) == 0 {
+		return jobStatusCancelled, nil
+	}
+	o.Provider = providers[0]
+	o.Provider.Keywords, err = fetchKeywords(o.ProviderID)
+	if err != nil {
+		return "", err
+	}
+
+	if reason := reminderSkipReason(j.RunAt, o.DeliveryDate, o.Provider.location(), time.Now()); reason != "" {
+		return jobStatusSkipped, errors.New(reason)
+	}
+
+	optedOut, err := isOptedOut(o.ContactNumber, o.ID)
+	if err != nil {
+		return "", err
+	}
+	if optedOut {
+		return jobStatusSkipped, errors.New("Customer opted out")
+	}
+
+	// held back until the quiet hours are over, keeping when it was first due
+	if qh := o.Provider.quietHours(); qh != nil {
+		now := time.Now()
+		if next := qh.nextAllowed(now, o.Provider.location()); next.After(now) {
+			if reason := reminderSkipReason(next, o.DeliveryDate, o.Provider.location(), next); reason != "" {
+				return jobStatusSkipped, errors.New("Quiet hours last until it is too late: " + reason)
+			}
+			if j.DeferredFrom == nil {
+				deferredFrom := j.RunAt
+				j.DeferredFrom = &deferredFrom
+			}
+			j.RunAt = next
+			return jobStatusPending, nil
 		}
+	}
 
-		o.Provider = p[0]
+	slots, err := fetchTimeSlotsForDate(dbConn, o.ProviderID, o.DeliveryDate, o.ID)
+	if err != nil {
+		return "", err
 	}
+	o.Provider.Slots = slots
 
-	for _, o := range orders {
-		go scheduleReminder(o, stopSignal)
+	if result, err := sendReminderSms(o, j.DeferredFrom); err != nil {
+		// part of the reminder went out already, another attempt would send it twice
+		if result != nil && result.MessageID != "" {
+			return jobStatusFailed, err
+		}
+		return "", err
 	}
+
+	return jobStatusDone, nil
+}
+
+// GET /api/cron/skipped
+func getSkippedReminders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := `
+		SELECT id, order_id, run_at, status, attempts, last_error, deferred_from
+		FROM reminder_jobs WHERE status = $1 ORDER BY run_at DESC LIMIT 500
+	`
+	jobs, err := fetchReminderJobs(query, jobStatusSkipped)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string][]*reminderJob{"jobs": jobs})
 }
 
 // GET /api/cron/test?customer_name=&contact_number=
@@ -49,7 +130,6 @@ func trialExecutionCron(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 	o := &order{
-		ID:            1,
 		CustomerName:  cName,
 		ContactNumber: cNumber,
 		DeliveryDate:  time.Now().Add(time.Hour * time.Duration(24)).UTC().Format("2006-01-02"),
@@ -57,15 +137,19 @@ func trialExecutionCron(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 			Title:         "Aramex",
 			ContactNumber: "+6587654321",
 			ReminderTime:  time.Now().Add(time.Minute * time.Duration(1)).UTC().Format("15:04"),
+			Timezone:      "UTC",
 			Slots: []*timeSlot{
-				&timeSlot{StartTime: "13", EndTime: "14"},
-				&timeSlot{StartTime: "14", EndTime: "15"},
-				&timeSlot{StartTime: "15", EndTime: "16"},
+				&timeSlot{StartTime: clockTime{Hour: 13}, EndTime: clockTime{Hour: 14}},
+				&timeSlot{StartTime: clockTime{Hour: 14}, EndTime: clockTime{Hour: 15}},
+				&timeSlot{StartTime: clockTime{Hour: 15}, EndTime: clockTime{Hour: 16}},
 			},
 		},
 	}
 
-	go scheduleReminder(o, stopSignal)
+	// not a real order so it cannot go through the reminder queue
+	time.AfterFunc(time.Minute, func() {
+		sendReminderSms(o, nil)
+	})
 
 	RenderJSON(w, o)
 }
@@ -74,7 +158,7 @@ func trialExecutionCron(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 func trialTriggerReminder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	orderID, _ := strconv.Atoi(ps.ByName("order_id"))
 
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, delivery_date, provider_id, retries_count FROM orders WHERE id = $1 AND NOT deleted`, orderID)
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, orderID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -85,75 +169,101 @@ func trialTriggerReminder(w http.ResponseWriter, r *http.Request, ps httprouter.
 	}
 	currOrder := orders[0]
 
-	providers, err := fetchProviders(`
-		SELECT id, title, contact_number, EXTRACT(HOUR FROM timezone('UTC', reminder_time))
-		FROM providers WHERE id = $1 AND NOT deleted`,
-		currOrder.ProviderID,
-	)
-	if err != nil {
+	// replaces the pending reminder of the order, if any
+	if err := enqueueReminderJob(currOrder.ID, time.Now().Add(time.Minute)); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	if len(providers) == 0 {
-		http.Error(w, "Invalid provider", 400)
-		return
-	}
-	currProvider := providers[0]
-
-	slots, err := fetchTimeSlots(`
-		SELECT id, EXTRACT(HOUR FROM start_time), EXTRACT(HOUR FROM end_time), provider_id
-		FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC
-	`, currProvider.ID)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	currProvider.Slots = slots
-
-	currOrder.DeliveryDate = time.Now().Add(time.Hour * time.Duration(24)).UTC().Format("2006-01-02")
-	currProvider.ReminderTime = time.Now().Add(time.Minute * time.Duration(1)).UTC().Format("15:04")
-	currOrder.Provider = currProvider
-
-	go scheduleReminder(currOrder, stopSignal)
 
 	RenderJSON(w, currOrder)
 }
 
-// scheduleReminder schedule new cron job for an order
-// to be used in a separate goroutine
+// scheduleReminder queue the reminder of an order,
+// moving its pending reminder if there is one.
+// A reminder time already past is still queued within the grace period, otherwise recorded as skipped.
 // order must have a valid reminder time from its Provider
 // that can be converted from string to integer or in "HH:MM" format.
 // order.DeliveryDate must be in format of 'YYYY-MM-DD'.
-// Both timing is assumed to be in UTC timezonea.
-func scheduleReminder(o *order, stopSignal <-chan int) {
-	if o.Provider.ReminderTime == "" {
-		return
+// Both timing are in the timezone of the provider.
+// Orders in one of unremindedStates have their reminder cancelled instead.
+func scheduleReminder(o *order) error {
+	if o.Provider.ReminderTime == "" || unremindedStates[o.ConversationState] {
+		return cancelReminderJobs(o.ID)
 	}
 
-	datetime, err := generateGoDateFromString(o.DeliveryDate, o.Provider.ReminderTime)
+	datetime, err := generateGoDateFromString(o.DeliveryDate, o.Provider.ReminderTime, o.Provider.location())
 	if err != nil {
-		log.Fatal("Failed to generate datetime of order", o.ID)
+		return err
 	}
 
 	// send one day before the delivery date
-	datetime = datetime.Add(time.Hour * time.Duration(-24))
+	datetime = datetime.AddDate(0, 0, -1)
+
+	// quiet hours lasting until the delivery date would hold the reminder back for good,
+	// so it goes out before they start instead
+	if qh := o.Provider.quietHours(); qh != nil {
+		deliveryStart, err := generateGoDateFromString(o.DeliveryDate, "0", o.Provider.location())
+		if err != nil {
+			return err
+		}
+		if !qh.nextAllowed(datetime, o.Provider.location()).Before(deliveryStart) {
+			datetime = qh.lastAllowedBefore(datetime, o.Provider.location())
+		}
+	}
+
 	if datetime.Before(time.Now()) {
-		return
+		if reason := reminderSkipReason(datetime, o.DeliveryDate, o.Provider.location(), time.Now()); reason != "" {
+			if err := cancelReminderJobs(o.ID); err != nil {
+				return err
+			}
+			return recordSkippedReminderJob(o.ID, datetime, reason)
+		}
+	}
+
+	return enqueueReminderJob(o.ID, datetime)
+}
+
+// rescheduleProviderReminders re-time the reminders of a provider's orders
+// after its reminder time changed.
+// Orders that were already reminded or delivered before today are left alone.
+func rescheduleProviderReminders(providerID int64) error {
+	providers, err := fetchProviders(`
+		SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale
+		FROM providers WHERE id = $1 AND NOT deleted`,
+		providerID,
+	)
+	if err != nil {
+		return err
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+
+	today := time.Now().In(providers[0].location()).Format("2006-01-02")
+	orders, err := fetchOrders(`
+		SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale
+		FROM orders WHERE provider_id = $1 AND NOT deleted AND delivery_date >= $3
+		AND NOT EXISTS (SELECT 1 FROM reminder_jobs WHERE order_id = orders.id AND status = $2)`,
+		providerID, jobStatusDone, today,
+	)
+	if err != nil {
+		return err
 	}
-	plan := chronos.NewOnceAtDatePlan(datetime)
-	task := chronos.NewScheduledTask(func() {
-		sendReminderSms(o)
-	}, plan)
-	defer task.Stop()
 
-	task.Start()
+	for _, o := range orders {
+		o.Provider = providers[0]
+		if err := scheduleReminder(o); err != nil {
+			return err
+		}
+	}
 
-	<-stopSignal
+	return nil
 }
 
 // dateStr in format YYYY-MM-DD
 // hourStr is format HH or HH:MM
-func generateGoDateFromString(dateStr, hourMinuteStr string) (time.Time, error) {
+// both are read as wall clock time in loc
+func generateGoDateFromString(dateStr, hourMinuteStr string, loc *time.Location) (time.Time, error) {
 	dateArr := strings.Split(dateStr, "-")
 	year, err := strconv.Atoi(dateArr[0])
 	if err != nil {
@@ -213,5 +323,5 @@ func generateGoDateFromString(dateStr, hourMinuteStr string) (time.Time, error)
 		}
 	}
 
-	return time.Date(year, month, date, hour, minute, 0, 0, time.UTC), nil
+	return time.Date(year, month, date, hour, minute, 0, 0, loc), nil
 }
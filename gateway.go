@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway deliver outbound sms through a concrete provider
+type Gateway interface {
+	Name() string
+	Send(toNumber string, body string) (*SendResult, error)
+}
+
+// SendResult is what a gateway reports after accepting a message
+type SendResult struct {
+	MessageID string   `json:"message_id"`
+	PartIDs   []string `json:"part_ids,omitempty"`
+	Status    string   `json:"status"`
+	Cost      float64  `json:"cost"`
+	CostUnit  string   `json:"cost_unit,omitempty"`
+	Gateway   string   `json:"gateway,omitempty"`
+}
+
+var smsGateway Gateway
+
+// newGatewayFromEnv build the gateways listed by priority in SMS_GATEWAYS, e.g. "twilio,fake",
+// or the single one selected by SMS_GATEWAY, "twilio" (default), "vonage", "smpp" or "fake".
+// SMS_ROUTES sends numbers by country prefix through a gateway first, e.g. "+65:twilio,+62:fake".
+// FAKE_SMS_FILE optionally makes the fake gateway append every message to a file.
+func newGatewayFromEnv() (Gateway, error) {
+	names := os.Getenv("SMS_GATEWAYS")
+	if names == "" {
+		names = os.Getenv("SMS_GATEWAY")
+	}
+
+	gateways := []Gateway{}
+	for _, name := range strings.Split(names, ",") {
+		g, err := newGateway(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range gateways {
+			if other.Name() == g.Name() {
+				return nil, errors.New("SMS gateway " + g.Name() + " is listed twice")
+			}
+		}
+		gateways = append(gateways, g)
+	}
+
+	routes, err := parseGatewayRoutes(os.Getenv("SMS_ROUTES"))
+	if err != nil {
+		return nil, err
+	}
+	return newGatewayRouter(gateways, routes)
+}
+
+// newGateway build the gateway called name
+func newGateway(name string) (Gateway, error) {
+	switch name {
+	case "", "twilio":
+		return &twilioGateway{}, nil
+	case "vonage":
+		return newVonageGateway(), nil
+	case "smpp":
+		g, err := newSmppGateway()
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	case "fake":
+		return &fakeGateway{filePath: os.Getenv("FAKE_SMS_FILE")}, nil
+	}
+	return nil, errors.New("Unknown SMS gateway " + name)
+}
+
+// findGateway return the configured gateway called name, nil if there is none
+func findGateway(name string) Gateway {
+	if r, ok := smsGateway.(*gatewayRouter); ok {
+		return r.gateway(name)
+	}
+	if smsGateway != nil && smsGateway.Name() == name {
+		return smsGateway
+	}
+	return nil
+}
+
+type fakeSms struct {
+	MessageID string    `json:"message_id"`
+	To        string    `json:"to"`
+	Body      string    `json:"body"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// fakeGateway keep every message in memory instead of sending it
+// so that the whole reminder flow can run locally without Twilio.
+type fakeGateway struct {
+	mu       sync.Mutex
+	filePath string
+	outbox   []*fakeSms
+}
+
+func (g *fakeGateway) Name() string {
+	return "fake"
+}
+
+func (g *fakeGateway) Send(toNumber string, body string) (*SendResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m := &fakeSms{
+		MessageID: "FAKE" + strconv.Itoa(len(g.outbox)+1),
+		To:        toNumber,
+		Body:      body,
+		SentAt:    time.Now(),
+	}
+	g.outbox = append(g.outbox, m)
+	log.Println("[fake sms] to", toNumber+":", body)
+
+	if g.filePath != "" {
+		f, err := os.OpenFile(g.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewEncoder(f).Encode(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SendResult{MessageID: m.MessageID, Status: "sent"}, nil
+}
+
+// sent return a copy of every message sent so far
+func (g *fakeGateway) sent() []*fakeSms {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]*fakeSms{}, g.outbox...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// gatewayError is a failure of one gateway that another one may not have,
+// e.g. a timeout or a 5xx response, when retryable is true
+type gatewayError struct {
+	msg       string
+	retryable bool
+}
+
+func (e *gatewayError) Error() string {
+	return e.msg
+}
+
+// isRetryable report whether sending through another gateway may succeed where err happened
+func isRetryable(err error) bool {
+	gErr, ok := err.(*gatewayError)
+	return ok && gErr.retryable
+}
+
+// gatewayRoute send numbers starting with Prefix through the gateway called Gateway first
+type gatewayRoute struct {
+	Prefix  string
+	Gateway string
+}
+
+// parseGatewayRoutes accept comma separated "+PREFIX:gateway", e.g. "+65:twilio,+62:fake"
+func parseGatewayRoutes(str string) ([]gatewayRoute, error) {
+	routes := []gatewayRoute{}
+	if strings.TrimSpace(str) == "" {
+		return routes, nil
+	}
+	for _, rule := range strings.Split(str, ",") {
+		parts := strings.Split(strings.TrimSpace(rule), ":")
+		if len(parts) != 2 || !validPrefix(parts[0]) || parts[1] == "" {
+			return nil, errors.New("Invalid route " + rule + ", expected +PREFIX:gateway")
+		}
+		routes = append(routes, gatewayRoute{Prefix: parts[0], Gateway: parts[1]})
+	}
+	return routes, nil
+}
+
+// validPrefix report whether prefix is a + followed by digits
+func validPrefix(prefix string) bool {
+	if len(prefix) < 2 || prefix[0] != '+' {
+		return false
+	}
+	for _, c := range prefix[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// gatewayRouter send through several gateways.
+// A number goes through the gateway of its longest matching route first, then through
+// every other gateway in priority order for as long as they fail with a retryable error.
+type gatewayRouter struct {
+	gateways []Gateway
+	routes   []gatewayRoute
+}
+
+// newGatewayRouter check that every route uses one of gateways, listed by priority
+func newGatewayRouter(gateways []Gateway, routes []gatewayRoute) (*gatewayRouter, error) {
+	if len(gateways) == 0 {
+		return nil, errors.New("No SMS gateway configured")
+	}
+	r := &gatewayRouter{gateways: gateways, routes: routes}
+	for _, route := range routes {
+		if r.gateway(route.Gateway) == nil {
+			return nil, errors.New("Route " + route.Prefix + " uses unknown gateway " + route.Gateway)
+		}
+	}
+	return r, nil
+}
+
+func (r *gatewayRouter) Name() string {
+	names := []string{}
+	for _, g := range r.gateways {
+		names = append(names, g.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Send try every candidate gateway until one accepts the message or fails for good.
+// The result names the gateway that accepted the message, or the last one tried on error
+// along with the IDs of the parts it sent if it sent only some of them.
+func (r *gatewayRouter) Send(toNumber string, body string) (*SendResult, error) {
+	errs := []string{}
+	var g Gateway
+	var result *SendResult
+	var err error
+	for _, g = range r.candidates(toNumber) {
+		result, err = g.Send(toNumber, body)
+		if err == nil {
+			result.Gateway = g.Name()
+			return result, nil
+		}
+		errs = append(errs, g.Name()+": "+err.Error())
+		if !isRetryable(err) {
+			break
+		}
+		log.Println("Gateway", g.Name(), "failed to send to", toNumber+", failing over:", err.Error())
+	}
+
+	if len(errs) > 1 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	if result == nil {
+		result = &SendResult{}
+	}
+	result.Gateway = g.Name()
+	return result, err
+}
+
+// candidates return the gateways to try for toNumber in order
+func (r *gatewayRouter) candidates(toNumber string) []Gateway {
+	var routed *gatewayRoute
+	for i, route := range r.routes {
+		if strings.HasPrefix(toNumber, route.Prefix) && (routed == nil || len(route.Prefix) > len(routed.Prefix)) {
+			routed = &r.routes[i]
+		}
+	}
+	if routed == nil {
+		return r.gateways
+	}
+
+	candidates := []Gateway{r.gateway(routed.Gateway)}
+	for _, g := range r.gateways {
+		if g.Name() != routed.Gateway {
+			candidates = append(candidates, g)
+		}
+	}
+	return candidates
+}
+
+// gateway return the gateway called name, nil if there is none
+func (r *gatewayRouter) gateway(name string) Gateway {
+	for _, g := range r.gateways {
+		if g.Name() == name {
+			return g
+		}
+	}
+	return nil
+}
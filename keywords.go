@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// keywords map an intent to the words a customer can reply to trigger it
+type keywords map[string][]string
+
+// localeKeywords are the keywords a provider overrides, by locale.
+// Intents a provider did not configure use defaultKeywords.
+type localeKeywords map[string]keywords
+
+// defaultKeywords is used for every intent a provider did not configure.
+// English keywords are understood whatever the locale of the customer.
+var defaultKeywords = localeKeywords{
+	localeEnglish: {
+		intentWrong:  {"WRONG"},
+		intentHelp:   {"HELP", "INFO"},
+		intentStatus: {"STATUS"},
+		intentCancel: {"CANCEL"},
+		intentStop:   {"STOP", "STOPALL", "UNSUBSCRIBE", "END", "QUIT"},
+		intentStart:  {"START", "UNSTOP", "SUBSCRIBE"},
+	},
+	localeMalay: {
+		intentWrong:  {"SALAH"},
+		intentHelp:   {"BANTUAN"},
+		intentStatus: {"STATUS"},
+		intentCancel: {"BATAL"},
+		intentStop:   {"BERHENTI"},
+		intentStart:  {"MULA"},
+	},
+	localeIndonesian: {
+		intentWrong:  {"SALAH"},
+		intentHelp:   {"BANTUAN"},
+		intentStatus: {"STATUS"},
+		intentCancel: {"BATAL"},
+		intentStop:   {"BERHENTI"},
+		intentStart:  {"MULAI"},
+	},
+	localeChinese: {
+		intentWrong:  {"错误", "錯誤"},
+		intentHelp:   {"帮助", "幫助"},
+		intentStatus: {"状态", "狀態"},
+		intentCancel: {"取消"},
+		intentStop:   {"退订", "退訂"},
+		intentStart:  {"订阅", "訂閱"},
+	},
+}
+
+// normalizeKeyword make matching insensitive to case, spacing and trailing punctuation
+func normalizeKeyword(str string) string {
+	return strings.Trim(strings.ToUpper(strings.Join(strings.Fields(str), " ")), ".!。！")
+}
+
+// words return the keywords of intent in locale, falling back to the default ones
+func (lk localeKeywords) words(locale, intent string) []string {
+	if words := lk[locale][intent]; len(words) > 0 {
+		return words
+	}
+	if words := defaultKeywords[locale][intent]; len(words) > 0 {
+		return words
+	}
+	return defaultKeywords[localeEnglish][intent]
+}
+
+// word return the keyword of intent to mention in messages in locale
+func (lk localeKeywords) word(locale, intent string) string {
+	return lk.words(locale, intent)[0]
+}
+
+// intentOf tell what an inbound sms body is asking for, from a customer texted in locale.
+// English keywords are always understood, and those of every locale when locale is empty.
+// Anything that is not a keyword is read as slot numbers.
+func (lk localeKeywords) intentOf(body, locale string) string {
+	locales := []string{locale, localeEnglish}
+	if locale == "" {
+		locales = supportedLocales
+	}
+
+	body = normalizeKeyword(body)
+	for _, l := range locales {
+		for intent := range defaultKeywords[localeEnglish] {
+			for _, word := range lk.words(l, intent) {
+				if normalizeKeyword(word) == body {
+					return intent
+				}
+			}
+		}
+	}
+	return intentChoice
+}
+
+// validate reject overrides that are unknown, empty, ambiguous or could be slot numbers.
+// Keywords of a locale must not clash with English ones as both are understood.
+func (lk localeKeywords) validate() error {
+	for locale, k := range lk {
+		if !isSupportedLocale(locale) {
+			return errors.New("Unknown locale " + locale)
+		}
+		for intent := range k {
+			if _, ok := defaultKeywords[localeEnglish][intent]; !ok {
+				return errors.New("Unknown keyword intent " + intent)
+			}
+		}
+	}
+
+	for _, locale := range supportedLocales {
+		seen := map[string]string{}
+		for _, l := range []string{localeEnglish, locale} {
+			for intent := range defaultKeywords[localeEnglish] {
+				for _, word := range lk.words(l, intent) {
+					word = normalizeKeyword(word)
+					if word == "" {
+						return errors.New("Empty keyword for " + intent)
+					}
+					if _, err := parseSlotReply(word, 100); err == nil {
+						return errors.New("Keyword " + word + " would be read as time slots")
+					}
+					if other, ok := seen[word]; ok && other != intent {
+						return errors.New("Keyword " + word + " is used for both " + other + " and " + intent)
+					}
+					seen[word] = intent
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// merged return every intent of locale with the keywords in effect
+func (lk localeKeywords) merged(locale string) keywords {
+	merged := keywords{}
+	for intent := range defaultKeywords[localeEnglish] {
+		merged[intent] = lk.words(locale, intent)
+	}
+	return merged
+}
+
+// mentions return the keyword to mention in messages in locale for every intent
+func (lk localeKeywords) mentions(locale string) map[string]string {
+	mentions := map[string]string{}
+	for intent := range defaultKeywords[localeEnglish] {
+		mentions[intent] = lk.word(locale, intent)
+	}
+	return mentions
+}
+
+// Scan implement sql.Scanner for JSONB columns
+func (lk *localeKeywords) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, lk)
+	case string:
+		return json.Unmarshal([]byte(v), lk)
+	case nil:
+		*lk = localeKeywords{}
+		return nil
+	}
+	return fmt.Errorf("Cannot scan %T into keywords", src)
+}
+
+// Value implement driver.Valuer
+func (lk localeKeywords) Value() (driver.Value, error) {
+	if lk == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(lk)
+	return string(b), err
+}
+
+// GET /api/provider/:id/keywords?locale=
+// locale is English by default
+func getProviderKeywords(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = localeEnglish
+	}
+	if !isSupportedLocale(locale) {
+		http.Error(w, "Unknown locale "+locale, 400)
+		return
+	}
+
+	lk, err := fetchKeywords(int64(ID))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if lk == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	RenderJSON(w, map[string]interface{}{"locale": locale, "keywords": lk.merged(locale)})
+}
+
+// PUT /api/provider/:id/keywords
+// {"locale": "ms", "keywords": {"stop": ["STOP", "BERHENTI"]}} replace the keywords of the intents given,
+// an empty list restore the default ones. locale is English by default.
+func setProviderKeywords(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	body := struct {
+		Locale   string   `json:"locale"`
+		Keywords keywords `json:"keywords"`
+	}{}
+	if err := ReadRequestBody(r, &body); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if body.Locale == "" {
+		body.Locale = localeEnglish
+	}
+	if !isSupportedLocale(body.Locale) {
+		http.Error(w, "Unknown locale "+body.Locale, 400)
+		return
+	}
+
+	lk, err := fetchKeywords(int64(ID))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if lk == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	k := lk[body.Locale]
+	if k == nil {
+		k = keywords{}
+		lk[body.Locale] = k
+	}
+	for intent, words := range body.Keywords {
+		if len(words) == 0 {
+			delete(k, intent)
+			continue
+		}
+		k[intent] = words
+	}
+	if err := lk.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	query := `UPDATE providers SET keywords = $1 WHERE id = $2`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, err := stmt.Exec(lk, ID); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string]interface{}{"locale": body.Locale, "keywords": lk.merged(body.Locale)})
+}
+
+// fetchKeywords return the keywords a provider overrides, nil if there is no such provider
+func fetchKeywords(providerID int64) (localeKeywords, error) {
+	rows, err := dbConn.Query(`SELECT keywords FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	lk := localeKeywords{}
+	if err := rows.Scan(&lk); err != nil {
+		return nil, err
+	}
+	return lk, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// languages customers can be texted in
+const (
+	localeEnglish    = "en"
+	localeMalay      = "ms"
+	localeIndonesian = "id"
+	localeChinese    = "zh"
+)
+
+var supportedLocales = []string{localeEnglish, localeMalay, localeIndonesian, localeChinese}
+
+// isSupportedLocale report whether messages can be sent in locale
+func isSupportedLocale(locale string) bool {
+	for _, l := range supportedLocales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+var localizedWeekdays = map[string][]string{
+	localeMalay:      {"Ahad", "Isnin", "Selasa", "Rabu", "Khamis", "Jumaat", "Sabtu"},
+	localeIndonesian: {"Minggu", "Senin", "Selasa", "Rabu", "Kamis", "Jumat", "Sabtu"},
+	localeChinese:    {"日", "一", "二", "三", "四", "五", "六"},
+}
+
+var localizedMonths = map[string][]string{
+	localeMalay:      {"Jan", "Feb", "Mac", "Apr", "Mei", "Jun", "Jul", "Ogo", "Sep", "Okt", "Nov", "Dis"},
+	localeIndonesian: {"Jan", "Feb", "Mar", "Apr", "Mei", "Jun", "Jul", "Agu", "Sep", "Okt", "Nov", "Des"},
+}
+
+// formatDate render a date the way customers of locale read it
+func formatDate(t time.Time, locale string) string {
+	day := strconv.Itoa(t.Day())
+	year := strconv.Itoa(t.Year())
+	switch locale {
+	case localeMalay, localeIndonesian:
+		return localizedWeekdays[locale][t.Weekday()] + ", " + day + " " + localizedMonths[locale][t.Month()-1] + " " + year
+	case localeChinese:
+		return year + "年" + strconv.Itoa(int(t.Month())) + "月" + day + "日（星期" + localizedWeekdays[locale][t.Weekday()] + "）"
+	}
+	return t.Format("Mon 2006 Jan 02")
+}
+
+// locale return the language to text the customer of an order in,
+// the default one of its provider unless the order has its own
+// order must have Provider populated
+func (o *order) locale() string {
+	if o.Locale != "" {
+		return o.Locale
+	}
+	if o.Provider != nil && o.Provider.DefaultLocale != "" {
+		return o.Provider.DefaultLocale
+	}
+	return localeEnglish
+}
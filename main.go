@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
@@ -23,7 +24,9 @@ var httpsClient *http.Client
 func init() {
 	pool := x509.NewCertPool()
 	pool.AppendCertsFromPEM(pemCerts)
+	// a gateway that hangs fails over like one that is down
 	httpsClient = &http.Client{
+		Timeout: 30 * time.Second,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{RootCAs: pool},
 		},
@@ -45,6 +48,12 @@ func main() {
 	dbConn = conn
 	defer conn.Close()
 
+	gateway, err := newGatewayFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	smsGateway = gateway
+
 	go initCron(stopSignal)
 	defer func() { stopSignal <- 1 }()
 
@@ -55,17 +64,39 @@ func main() {
 	httpRouter.GET("/api/provider", getAllProviders)
 	httpRouter.GET("/api/provider/:id", getProviderByID)
 	httpRouter.DELETE("/api/provider/:id", deleteProvider)
+	httpRouter.PUT("/api/provider/:id/quiet_hours", setProviderQuietHours)
+	httpRouter.GET("/api/provider/:id/templates", getProviderTemplates)
+	httpRouter.PUT("/api/provider/:id/templates", setProviderTemplates)
+	httpRouter.POST("/api/provider/:id/templates/preview", previewProviderTemplate)
+	httpRouter.GET("/api/provider/:id/keywords", getProviderKeywords)
+	httpRouter.PUT("/api/provider/:id/keywords", setProviderKeywords)
+	httpRouter.POST("/api/provider/:id/blackouts", createNewBlackout)
+	httpRouter.POST("/api/provider/:id/blackouts/shift", shiftOrdersOffBlackouts)
+	httpRouter.GET("/api/provider/:id/blackouts", getBlackoutsByProvider)
+	httpRouter.DELETE("/api/provider/:id/blackouts/:blackout_id", deleteBlackout)
 
 	httpRouter.POST("/api/time_slot", createNewTimeSlot)
 	httpRouter.GET("/api/time_slot/:provider_id", getTimeSlotsByProvider)
+	httpRouter.PUT("/api/time_slot/:id/capacity", setTimeSlotCapacity)
 	httpRouter.DELETE("/api/time_slot/:id", deleteTimeSlot)
 
 	httpRouter.POST("/api/sms", sendAnSms)
-	httpRouter.POST("/api/sms/reply", respondToSms)
+	httpRouter.POST("/api/opt_out", createNewOptOut)
+	httpRouter.GET("/api/opt_out", getOptOuts)
+	httpRouter.DELETE("/api/opt_out/:id", deleteOptOut)
+	httpRouter.POST("/api/sms/reply", requireTwilioSignature(respondToSms))
+	httpRouter.POST("/api/sms/status", requireTwilioSignature(updateSmsStatus))
+	httpRouter.GET("/api/sms/vonage/reply", requireVonageSignature(respondToVonageSms))
+	httpRouter.POST("/api/sms/vonage/reply", requireVonageSignature(respondToVonageSms))
+	httpRouter.GET("/api/sms/vonage/status", requireVonageSignature(updateVonageSmsStatus))
+	httpRouter.POST("/api/sms/vonage/status", requireVonageSignature(updateVonageSmsStatus))
+	httpRouter.GET("/api/sms/outbox", getFakeOutbox)
 
 	httpRouter.POST("/api/order", createNewOrder)
 	httpRouter.POST("/api/order/:provider_id/csv_upload", newOrdersFromCsv)
 	httpRouter.GET("/api/order/:provider_id", getOrdersByProvider)
+	httpRouter.GET("/api/order/:provider_id/messages", getMessagesByOrder)
+	httpRouter.PUT("/api/order/:id", updateOrder)
 	httpRouter.DELETE("/api/order/:id", deleteOrder)
 
 	httpRouter.POST("/api/choice", createNewChoice)
@@ -73,6 +104,7 @@ func main() {
 	httpRouter.DELETE("/api/choice/:order_id/:time_slot_id", deleteChoice)
 
 	httpRouter.GET("/api/cron/test", trialExecutionCron)
+	httpRouter.GET("/api/cron/skipped", getSkippedReminders)
 	httpRouter.GET("/api/cron/trigger/:order_id", trialTriggerReminder)
 
 	routerWithCors := cors.AllowAll().Handler(httpRouter)
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+const (
+	directionOutbound = "outbound"
+	directionInbound  = "inbound"
+
+	messageStatusReceived    = "received"
+	messageStatusDelivered   = "delivered"
+	messageStatusUndelivered = "undelivered"
+	messageStatusFailed      = "failed"
+	messageStatusSuppressed  = "suppressed"
+)
+
+type message struct {
+	ID            int64      `json:"id"`
+	OrderID       int64      `json:"order_id,omitempty"`
+	Direction     string     `json:"direction"`
+	ContactNumber string     `json:"contact_number"`
+	Body          string     `json:"body"`
+	Gateway       string     `json:"gateway,omitempty"`
+	GatewaySID    string     `json:"gateway_sid,omitempty"`
+	PartSIDs      []string   `json:"part_sids,omitempty"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	SlotMenu      []int64    `json:"slot_menu,omitempty"`
+	DeferredFrom  *time.Time `json:"deferred_from,omitempty"`
+	Encoding      string     `json:"encoding,omitempty"`
+	Segments      int        `json:"segments,omitempty"`
+	EstimatedCost float64    `json:"estimated_cost"`
+	CostUnit      string     `json:"cost_unit,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	// Reply is set on answers to a message from the customer, sent even when they opted out
+	Reply bool `json:"-"`
+}
+
+// GET /api/order/:id/messages
+// registered as /api/order/:provider_id/messages since httprouter
+// requires wildcards in the same segment to share a name
+func getMessagesByOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	orderID, _ := strconv.Atoi(ps.ByName("provider_id"))
+
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1`, orderID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(orders) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	query := `
+		SELECT id, order_id, direction, contact_number, body, gateway, gateway_sid, part_sids, status, error, slot_menu, deferred_from, encoding, segments, estimated_cost, cost_unit, created_at, updated_at
+		FROM messages WHERE order_id = $1 ORDER BY created_at ASC, id ASC
+	`
+	messages, err := fetchMessages(query, orderID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string][]*message{"messages": messages})
+}
+
+// recordOutboundMessage log a message handed to the gateway, along with which gateway it went through
+// and the IDs of the parts it sent, even when it failed to send the others.
+// m.OrderID of 0 means the message is not tied to any order
+func recordOutboundMessage(m *message, result *SendResult, sendErr error) {
+	m.Direction = directionOutbound
+	if result != nil {
+		m.Gateway = result.Gateway
+		m.GatewaySID = result.MessageID
+		m.PartSIDs = result.PartIDs
+	}
+	if sendErr != nil {
+		m.Status = messageStatusFailed
+		m.Error = sendErr.Error()
+	} else {
+		m.Status = result.Status
+	}
+
+	if err := insertMessage(m); err != nil {
+		log.Println("Failed to record outbound message to", m.ContactNumber, ":", err.Error())
+	}
+}
+
+// inboundDedupeWindow is how long a reply is ignored when delivered again by gateway.
+// SMPP gives no ID to replies so they are told apart by their content,
+// which a customer may well send again later on.
+func inboundDedupeWindow(gateway string) time.Duration {
+	if gateway == "smpp" {
+		return 10 * time.Minute
+	}
+	return 24 * time.Hour
+}
+
+// recordInboundMessage log a reply received from a customer, not tied to any order yet.
+// recorded is false when the gateway already delivered a reply with the same s.GatewaySID.
+func recordInboundMessage(s *sms) (m *message, recorded bool, err error) {
+	m = &message{
+		Direction:     directionInbound,
+		ContactNumber: s.From,
+		Body:          s.Body,
+		Gateway:       s.Gateway,
+		GatewaySID:    s.GatewaySID,
+		Status:        messageStatusReceived,
+	}
+
+	if s.GatewaySID != "" {
+		query := `
+			SELECT EXISTS (
+				SELECT 1 FROM messages WHERE direction = $1 AND gateway = $2 AND gateway_sid = $3 AND created_at > $4
+			)
+		`
+		var seen bool
+		since := time.Now().Add(-inboundDedupeWindow(s.Gateway))
+		if err := dbConn.QueryRow(query, directionInbound, s.Gateway, s.GatewaySID, since).Scan(&seen); err != nil {
+			return nil, false, err
+		}
+		if seen {
+			return m, false, nil
+		}
+	}
+
+	if err := insertMessage(m); err != nil {
+		return nil, false, err
+	}
+	return m, true, nil
+}
+
+// setMessageOrder tie a recorded message to the order it turned out to be about
+func setMessageOrder(messageID, orderID int64) error {
+	query := `UPDATE messages SET order_id = $2 WHERE id = $1`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(messageID, orderID)
+	return err
+}
+
+// updateMessageStatus apply a delivery update from the gateway to an outbound message,
+// found by the ID of any of its parts.
+// Callbacks may arrive out of order so a final status is never replaced by an earlier one,
+// which also keeps the status of the first part of a long message to get one.
+func updateMessageStatus(gatewaySID, status, errStr string) error {
+	query := `
+		UPDATE messages SET status = $2, error = COALESCE($3, error), updated_at = NOW()
+		WHERE (gateway_sid = $1 OR part_sids @> ARRAY[$1]::VARCHAR(64)[])
+		AND direction = $4 AND status NOT IN ($5, $6, $7)
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		gatewaySID, status, sql.NullString{String: errStr, Valid: errStr != ""}, directionOutbound,
+		messageStatusDelivered, messageStatusUndelivered, messageStatusFailed,
+	)
+	return err
+}
+
+// latestSlotMenu return the slot ids, in menu order, of the last slot menu sent for an order
+// or nil if none was ever sent
+func latestSlotMenu(orderID int64) ([]int64, error) {
+	query := `
+		SELECT slot_menu FROM messages
+		WHERE order_id = $1 AND direction = $2 AND slot_menu IS NOT NULL
+		ORDER BY created_at DESC, id DESC LIMIT 1
+	`
+	var slotMenu []int64
+	err := dbConn.QueryRow(query, orderID, directionOutbound).Scan(pq.Array(&slotMenu))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return slotMenu, err
+}
+
+func insertMessage(m *message) error {
+	query := `
+		INSERT INTO messages(
+			order_id, direction, contact_number, body, gateway_sid, status, error, slot_menu, deferred_from,
+			encoding, segments, estimated_cost, cost_unit, gateway, part_sids
+		)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id
+	`
+	orderID := sql.NullInt64{Int64: m.OrderID, Valid: m.OrderID != 0}
+	gatewaySID := sql.NullString{String: m.GatewaySID, Valid: m.GatewaySID != ""}
+	errStr := sql.NullString{String: m.Error, Valid: m.Error != ""}
+	var slotMenu, partSIDs interface{}
+	if m.SlotMenu != nil {
+		slotMenu = pq.Array(m.SlotMenu)
+	}
+	if len(m.PartSIDs) > 0 {
+		partSIDs = pq.Array(m.PartSIDs)
+	}
+
+	return dbConn.QueryRow(
+		query, orderID, m.Direction, m.ContactNumber, m.Body, gatewaySID, m.Status, errStr, slotMenu, m.DeferredFrom,
+		m.Encoding, m.Segments, m.EstimatedCost, m.CostUnit, m.Gateway, partSIDs,
+	).Scan(&m.ID)
+}
+
+func fetchMessages(query string, args ...interface{}) ([]*message, error) {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*message, 0)
+	for rows.Next() {
+		m := new(message)
+		var orderID sql.NullInt64
+		var gatewaySID, errStr sql.NullString
+		err = rows.Scan(&m.ID, &orderID, &m.Direction, &m.ContactNumber, &m.Body, &m.Gateway, &gatewaySID, pq.Array(&m.PartSIDs), &m.Status, &errStr, pq.Array(&m.SlotMenu), &m.DeferredFrom, &m.Encoding, &m.Segments, &m.EstimatedCost, &m.CostUnit, &m.CreatedAt, &m.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.OrderID = orderID.Int64
+		m.GatewaySID = gatewaySID.String
+		m.Error = errStr.String
+
+		results = append(results, m)
+	}
+
+	return results, nil
+}
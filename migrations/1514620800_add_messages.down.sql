@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS index_messages_gateway_sid;
+DROP INDEX IF EXISTS index_messages_order;
+DROP TABLE IF EXISTS messages;
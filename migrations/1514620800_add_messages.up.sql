@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS messages (
+  id SERIAL,
+  order_id INT,
+  direction VARCHAR(10) NOT NULL,
+  contact_number VARCHAR(20) NOT NULL,
+  body TEXT NOT NULL,
+  gateway_sid VARCHAR(64),
+  status VARCHAR(20) NOT NULL,
+  error TEXT,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(id),
+  FOREIGN KEY(order_id) REFERENCES orders(id)
+);
+CREATE INDEX index_messages_order ON messages(order_id);
+CREATE INDEX index_messages_gateway_sid ON messages(gateway_sid);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS index_unique_pending_reminder;
+DROP INDEX IF EXISTS index_reminder_jobs_due;
+DROP TABLE IF EXISTS reminder_jobs;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS reminder_jobs (
+  id SERIAL,
+  order_id INT NOT NULL,
+  run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'pending',
+  attempts SMALLINT NOT NULL DEFAULT 0,
+  last_error TEXT,
+  locked_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(id),
+  FOREIGN KEY(order_id) REFERENCES orders(id)
+);
+CREATE INDEX index_reminder_jobs_due ON reminder_jobs(run_at) WHERE status = 'pending';
+CREATE UNIQUE INDEX index_unique_pending_reminder ON reminder_jobs(order_id) WHERE status = 'pending';
+INSERT INTO reminder_jobs(order_id, run_at)
+SELECT orders.id, ((orders.delivery_date - 1) + timezone('UTC', providers.reminder_time)::time) AT TIME ZONE 'UTC'
+FROM orders INNER JOIN providers ON providers.id = orders.provider_id
+WHERE NOT orders.deleted
+AND providers.reminder_time IS NOT NULL
+AND ((orders.delivery_date - 1) + timezone('UTC', providers.reminder_time)::time) AT TIME ZONE 'UTC' > NOW();
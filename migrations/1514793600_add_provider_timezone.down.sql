@@ -0,0 +1,2 @@
+ALTER TABLE providers ALTER COLUMN reminder_time TYPE TIME WITH TIME ZONE USING (timezone('UTC', (CURRENT_DATE + reminder_time) AT TIME ZONE timezone)::time::text || '+00')::timetz;
+ALTER TABLE providers DROP COLUMN IF EXISTS timezone;
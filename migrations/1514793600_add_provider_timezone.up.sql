@@ -0,0 +1,2 @@
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+ALTER TABLE providers ALTER COLUMN reminder_time TYPE TIME WITHOUT TIME ZONE USING timezone('UTC', reminder_time)::time;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS time_slot_capacities;
+ALTER TABLE time_slots DROP COLUMN IF EXISTS capacity;
@@ -0,0 +1,8 @@
+ALTER TABLE time_slots ADD COLUMN IF NOT EXISTS capacity INT;
+CREATE TABLE IF NOT EXISTS time_slot_capacities (
+  time_slot_id INT NOT NULL,
+  delivery_date DATE NOT NULL,
+  capacity INT NOT NULL,
+  PRIMARY KEY(time_slot_id, delivery_date),
+  FOREIGN KEY(time_slot_id) REFERENCES time_slots(id)
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS index_unique_time_slot;
+UPDATE time_slots SET deleted = TRUE WHERE days_of_week IS NOT NULL OR valid_from IS NOT NULL OR valid_until IS NOT NULL;
+CREATE UNIQUE INDEX index_unique_time_slot on time_slots(provider_id, start_time, end_time) WHERE NOT deleted;
+ALTER TABLE time_slots DROP COLUMN IF EXISTS valid_until;
+ALTER TABLE time_slots DROP COLUMN IF EXISTS valid_from;
+ALTER TABLE time_slots DROP COLUMN IF EXISTS days_of_week;
@@ -0,0 +1,8 @@
+ALTER TABLE time_slots ADD COLUMN IF NOT EXISTS days_of_week SMALLINT[];
+ALTER TABLE time_slots ADD COLUMN IF NOT EXISTS valid_from DATE;
+ALTER TABLE time_slots ADD COLUMN IF NOT EXISTS valid_until DATE;
+DROP INDEX IF EXISTS index_unique_time_slot;
+CREATE UNIQUE INDEX index_unique_time_slot ON time_slots(
+  provider_id, start_time, end_time,
+  COALESCE(days_of_week, '{}'), COALESCE(valid_from, '-infinity'), COALESCE(valid_until, 'infinity')
+) WHERE NOT deleted;
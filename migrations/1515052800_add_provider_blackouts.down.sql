@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS index_unique_provider_blackout;
+DROP TABLE IF EXISTS provider_blackouts;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS provider_blackouts (
+  id SERIAL,
+  provider_id INT NOT NULL,
+  blackout_date DATE NOT NULL,
+  reason VARCHAR(255) NOT NULL DEFAULT '',
+  deleted BOOLEAN DEFAULT FALSE,
+  PRIMARY KEY(id),
+  FOREIGN KEY(provider_id) REFERENCES providers(id)
+);
+CREATE UNIQUE INDEX index_unique_provider_blackout ON provider_blackouts(provider_id, blackout_date) WHERE NOT deleted;
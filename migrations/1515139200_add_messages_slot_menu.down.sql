@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS index_messages_order_slot_menu;
+ALTER TABLE messages DROP COLUMN IF EXISTS slot_menu;
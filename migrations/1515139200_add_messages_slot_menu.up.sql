@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS slot_menu INT[];
+CREATE INDEX index_messages_order_slot_menu ON messages(order_id, created_at) WHERE slot_menu IS NOT NULL;
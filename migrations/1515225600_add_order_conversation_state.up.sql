@@ -0,0 +1,4 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS conversation_state VARCHAR(30) NOT NULL DEFAULT 'awaiting_choice';
+UPDATE orders SET conversation_state = 'confirmed'
+WHERE EXISTS (SELECT 1 FROM choices WHERE choices.order_id = orders.id AND NOT choices.deleted);
+UPDATE orders SET conversation_state = 'locked' WHERE retries_count >= 3;
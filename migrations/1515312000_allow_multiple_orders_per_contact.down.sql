@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS index_orders_contact_number;
+ALTER TABLE orders DROP COLUMN IF EXISTS code;
+UPDATE orders SET deleted = TRUE WHERE NOT deleted AND id NOT IN (
+  SELECT MAX(id) FROM orders WHERE NOT deleted GROUP BY contact_number
+);
+CREATE UNIQUE INDEX index_unique_customer_contact ON orders (contact_number) WHERE NOT deleted;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS index_unique_customer_contact;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS code VARCHAR(8) NOT NULL
+DEFAULT upper(translate(substr(md5(random()::text), 1, 4), '0123456789', 'ghjkmnpqrs'));
+CREATE INDEX index_orders_contact_number ON orders(contact_number) WHERE NOT deleted;
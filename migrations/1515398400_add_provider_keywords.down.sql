@@ -0,0 +1,2 @@
+ALTER TABLE providers DROP COLUMN IF EXISTS keywords;
+UPDATE orders SET conversation_state = 'escalated' WHERE conversation_state = 'cancel_requested';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS index_unique_opt_out;
+DROP TABLE IF EXISTS opt_outs;
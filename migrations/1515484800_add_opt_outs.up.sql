@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS opt_outs (
+  id SERIAL PRIMARY KEY,
+  contact_number VARCHAR(20) NOT NULL,
+  provider_id INT REFERENCES providers(id),
+  source VARCHAR(20) NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  deleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE UNIQUE INDEX index_unique_opt_out ON opt_outs(contact_number, COALESCE(provider_id, 0)) WHERE NOT deleted;
@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS deferred_from;
+ALTER TABLE reminder_jobs DROP COLUMN IF EXISTS deferred_from;
+ALTER TABLE providers DROP COLUMN IF EXISTS quiet_hours_end;
+ALTER TABLE providers DROP COLUMN IF EXISTS quiet_hours_start;
@@ -0,0 +1,4 @@
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS quiet_hours_start TIME WITHOUT TIME ZONE;
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS quiet_hours_end TIME WITHOUT TIME ZONE;
+ALTER TABLE reminder_jobs ADD COLUMN IF NOT EXISTS deferred_from TIMESTAMP WITH TIME ZONE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deferred_from TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS provider_templates (
+  id SERIAL,
+  provider_id INT NOT NULL,
+  name VARCHAR(30) NOT NULL,
+  body TEXT NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(id),
+  FOREIGN KEY(provider_id) REFERENCES providers(id),
+  CONSTRAINT unique_provider_template UNIQUE(provider_id, name)
+);
@@ -0,0 +1,7 @@
+UPDATE providers SET keywords = COALESCE(keywords->'en', '{}');
+DELETE FROM provider_templates WHERE locale <> 'en';
+ALTER TABLE provider_templates DROP CONSTRAINT IF EXISTS unique_provider_template;
+ALTER TABLE provider_templates ADD CONSTRAINT unique_provider_template UNIQUE(provider_id, name);
+ALTER TABLE provider_templates DROP COLUMN IF EXISTS locale;
+ALTER TABLE orders DROP COLUMN IF EXISTS locale;
+ALTER TABLE providers DROP COLUMN IF EXISTS default_locale;
@@ -0,0 +1,6 @@
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS default_locale VARCHAR(10) NOT NULL DEFAULT 'en';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE provider_templates ADD COLUMN IF NOT EXISTS locale VARCHAR(10) NOT NULL DEFAULT 'en';
+ALTER TABLE provider_templates DROP CONSTRAINT IF EXISTS unique_provider_template;
+ALTER TABLE provider_templates ADD CONSTRAINT unique_provider_template UNIQUE(provider_id, locale, name);
+UPDATE providers SET keywords = jsonb_build_object('en', keywords) WHERE keywords <> '{}';
@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS cost_unit;
+ALTER TABLE messages DROP COLUMN IF EXISTS estimated_cost;
+ALTER TABLE messages DROP COLUMN IF EXISTS segments;
+ALTER TABLE messages DROP COLUMN IF EXISTS encoding;
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS gateway VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS index_unique_order_code;
+DROP TRIGGER IF EXISTS trigger_unique_order_code
+ON orders;
+DROP FUNCTION IF EXISTS regenerate_order_code;
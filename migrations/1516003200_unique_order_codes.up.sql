@@ -0,0 +1,23 @@
+CREATE OR REPLACE FUNCTION regenerate_order_code()
+RETURNS trigger AS
+$BODY$
+BEGIN
+  WHILE NOT NEW.deleted AND EXISTS (
+    SELECT 1 FROM orders
+    WHERE contact_number = NEW.contact_number AND code = NEW.code AND NOT deleted AND id <> NEW.id
+  ) LOOP
+    NEW.code := upper(translate(substr(md5(random()::text), 1, 4), '0123456789', 'ghjkmnpqrs'));
+  END LOOP;
+  RETURN NEW;
+END;
+$BODY$
+LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS trigger_unique_order_code
+ON orders;
+CREATE TRIGGER trigger_unique_order_code
+BEFORE INSERT OR UPDATE OF contact_number, code, deleted ON orders FOR EACH ROW
+EXECUTE PROCEDURE regenerate_order_code();
+UPDATE orders SET code = code WHERE NOT deleted AND id NOT IN (
+  SELECT MIN(id) FROM orders WHERE NOT deleted GROUP BY contact_number, code
+);
+CREATE UNIQUE INDEX IF NOT EXISTS index_unique_order_code ON orders (contact_number, code) WHERE NOT deleted;
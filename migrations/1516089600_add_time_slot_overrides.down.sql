@@ -0,0 +1 @@
+ALTER TABLE time_slots DROP COLUMN IF EXISTS overrides;
@@ -0,0 +1,2 @@
+ALTER TABLE time_slots ADD COLUMN IF NOT EXISTS overrides BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE time_slots SET overrides = TRUE WHERE valid_from IS NOT NULL AND valid_until IS NOT NULL;
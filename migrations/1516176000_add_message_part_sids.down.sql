@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS index_messages_part_sids;
+ALTER TABLE messages DROP COLUMN IF EXISTS part_sids;
@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS part_sids VARCHAR(64)[];
+CREATE INDEX IF NOT EXISTS index_messages_part_sids ON messages USING GIN (part_sids);
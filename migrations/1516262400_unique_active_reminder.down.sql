@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS index_unique_active_reminder;
+CREATE UNIQUE INDEX IF NOT EXISTS index_unique_pending_reminder ON reminder_jobs(order_id) WHERE status = 'pending';
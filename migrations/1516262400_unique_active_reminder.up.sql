@@ -0,0 +1,5 @@
+UPDATE reminder_jobs SET status = 'cancelled', updated_at = NOW() WHERE status = 'pending' AND order_id IN (
+  SELECT order_id FROM reminder_jobs WHERE status = 'running'
+);
+DROP INDEX IF EXISTS index_unique_pending_reminder;
+CREATE UNIQUE INDEX IF NOT EXISTS index_unique_active_reminder ON reminder_jobs(order_id) WHERE status IN ('pending', 'running');
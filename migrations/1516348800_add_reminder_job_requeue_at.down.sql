@@ -0,0 +1 @@
+ALTER TABLE reminder_jobs DROP COLUMN IF EXISTS requeue_at;
@@ -0,0 +1 @@
+ALTER TABLE reminder_jobs ADD COLUMN IF NOT EXISTS requeue_at TIMESTAMP WITH TIME ZONE;
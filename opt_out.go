@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// where an opt out came from
+const (
+	optOutSourceSms   = "sms"
+	optOutSourceAdmin = "admin"
+)
+
+// optOut stop every message to ContactNumber, or only the ones about
+// orders of ProviderID when set
+type optOut struct {
+	ID            int64     `json:"id"`
+	ContactNumber string    `json:"contact_number" schema:"contact_number"`
+	ProviderID    *int64    `json:"provider_id" schema:"provider_id"`
+	Source        string    `json:"source"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// POST /api/opt_out
+func createNewOptOut(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	oo := optOut{}
+	if err := ReadRequestBody(r, &oo); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if oo.ContactNumber == "" {
+		http.Error(w, "Missing contact_number", 400)
+		return
+	}
+
+	if err := addOptOut(oo.ContactNumber, oo.ProviderID, optOutSourceAdmin); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string]string{})
+}
+
+// GET /api/opt_out
+// optionally filtered by ?contact_number= and/or ?provider_id=
+func getOptOuts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	queryVals := r.URL.Query()
+	contactNumber := queryVals.Get("contact_number")
+	providerID, _ := strconv.Atoi(queryVals.Get("provider_id"))
+
+	query := `
+		SELECT id, contact_number, provider_id, source, created_at FROM opt_outs
+		WHERE NOT deleted AND ($1 = '' OR contact_number = $1) AND ($2 = 0 OR provider_id = $2)
+		ORDER BY created_at DESC
+	`
+	optOuts, err := fetchOptOuts(query, contactNumber, providerID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string][]*optOut{"opt_outs": optOuts})
+}
+
+// DELETE /api/opt_out/:id
+func deleteOptOut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+
+	query := `UPDATE opt_outs SET deleted = TRUE WHERE id = $1 AND NOT deleted`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res, err := stmt.Exec(ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if rowsAffected <= 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	RenderJSON(w, map[string]string{})
+}
+
+// addOptOut stop messages to contactNumber, about orders of providerID only when not nil
+func addOptOut(contactNumber string, providerID *int64, source string) error {
+	query := `
+		INSERT INTO opt_outs(contact_number, provider_id, source) VALUES($1, $2, $3)
+		ON CONFLICT (contact_number, COALESCE(provider_id, 0)) WHERE NOT deleted DO NOTHING
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(contactNumber, nullableID(providerID), source)
+	return err
+}
+
+// removeOptOuts let messages to contactNumber through again,
+// about orders of providerID when not nil or from any provider otherwise
+func removeOptOuts(contactNumber string, providerID *int64) error {
+	query := `UPDATE opt_outs SET deleted = TRUE WHERE contact_number = $1 AND (provider_id IS NULL OR $2::INT IS NULL OR provider_id = $2) AND NOT deleted`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(contactNumber, nullableID(providerID))
+	return err
+}
+
+// isOptedOut report whether messages to contactNumber about orderID (0 for none) must not be sent
+func isOptedOut(contactNumber string, orderID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM opt_outs WHERE contact_number = $1 AND NOT deleted
+			AND (provider_id IS NULL OR provider_id = (SELECT provider_id FROM orders WHERE id = $2))
+		)
+	`
+	var optedOut bool
+	err := dbConn.QueryRow(query, contactNumber, orderID).Scan(&optedOut)
+	return optedOut, err
+}
+
+func nullableID(ID *int64) sql.NullInt64 {
+	if ID == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *ID, Valid: true}
+}
+
+func fetchOptOuts(query string, args ...interface{}) ([]*optOut, error) {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*optOut, 0)
+	for rows.Next() {
+		oo := new(optOut)
+		var providerID sql.NullInt64
+		err = rows.Scan(&oo.ID, &oo.ContactNumber, &providerID, &oo.Source, &oo.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if providerID.Valid {
+			oo.ProviderID = &providerID.Int64
+		}
+
+		results = append(results, oo)
+	}
+
+	return results, nil
+}
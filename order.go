@@ -5,19 +5,27 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
 )
 
 type order struct {
-	ID            int64     `json:"id"`
-	CustomerName  string    `json:"customer_name" schema:"customer_name"`
-	ContactNumber string    `json:"contact_number" schema:"contact_number"`
-	DeliveryDate  string    `json:"delivery_date" schema:"delivery_date"`
-	ProviderID    int64     `json:"provider_id" schema:"provider_id"`
-	RetriesCount  int64     `json:"retries_count"`
-	Choices       []*choice `json:"choices,omitempty"`
-	Provider      *provider `json:"provider,omitempty"`
+	ID                int64     `json:"id"`
+	CustomerName      string    `json:"customer_name" schema:"customer_name"`
+	ContactNumber     string    `json:"contact_number" schema:"contact_number"`
+	DeliveryDate      string    `json:"delivery_date" schema:"delivery_date"`
+	ProviderID        int64     `json:"provider_id" schema:"provider_id"`
+	RetriesCount      int64     `json:"retries_count"`
+	ConversationState string    `json:"conversation_state"`
+	Code              string    `json:"code"`
+	Locale            string    `json:"locale" schema:"locale"`
+	Choices           []*choice `json:"choices,omitempty"`
+	Provider          *provider `json:"provider,omitempty"`
+	// replying is set while handling a message from the customer
+	replying bool
 }
 
 // POST /api/order
@@ -29,7 +37,7 @@ func createNewOrder(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	providers, err := fetchProviders(`
-		SELECT id, title, contact_number, EXTRACT(HOUR FROM timezone('UTC', reminder_time))
+		SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale
 		FROM providers WHERE id = $1 AND NOT deleted`,
 		o.ProviderID,
 	)
@@ -42,23 +50,38 @@ func createNewOrder(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		return
 	}
 
-	query := `INSERT INTO orders(customer_name, contact_number, delivery_date, provider_id) VALUES($1, $2, $3, $4) RETURNING id`
+	if o.Locale != "" && !isSupportedLocale(o.Locale) {
+		http.Error(w, "Unknown locale "+o.Locale, 400)
+		return
+	}
+
+	onBlackout, err := isBlackoutDate(o.ProviderID, o.DeliveryDate)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if onBlackout {
+		http.Error(w, "Delivery date falls on a provider blackout", 400)
+		return
+	}
+
+	query := `INSERT INTO orders(customer_name, contact_number, delivery_date, provider_id, locale) VALUES($1, $2, $3, $4, $5) RETURNING id`
 	var ID int64
-	err = dbConn.QueryRow(query, o.CustomerName, o.ContactNumber, o.DeliveryDate, o.ProviderID).Scan(&ID)
+	err = dbConn.QueryRow(query, o.CustomerName, o.ContactNumber, o.DeliveryDate, o.ProviderID, o.Locale).Scan(&ID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	slots, err := fetchTimeSlots(`
-		SELECT id, EXTRACT(HOUR FROM start_time), EXTRACT(HOUR FROM end_time), provider_id
+		SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides
 		FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC
 	`, o.ProviderID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE id = $1 AND NOT deleted`, ID)
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, ID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -72,12 +95,17 @@ func createNewOrder(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	// launch reminder
 	o.Provider = providers[0]
 	o.Provider.Slots = slots
-	go scheduleReminder(&o, stopSignal)
+	if err := scheduleReminder(&o); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	RenderJSON(w, map[string]int64{"id": ID})
 }
 
 // POST /api/order/:provider_id/csv_upload
+// columns are customer name, contact number, delivery date and optionally locale,
+// the provider default locale being used when it is left empty
 func newOrdersFromCsv(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	providerID, _ := strconv.Atoi(ps.ByName("provider_id"))
 	filePath, err := ReadFileUpload(r, "orders_csv")
@@ -105,7 +133,7 @@ func newOrdersFromCsv(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 
 	providers, err := fetchProviders(`
-		SELECT id, title, contact_number, EXTRACT(HOUR FROM timezone('UTC', reminder_time))
+		SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale
 		FROM providers WHERE id = $1 AND NOT deleted`,
 		providerID,
 	)
@@ -120,7 +148,7 @@ func newOrdersFromCsv(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	currProvider := providers[0]
 
 	slots, err := fetchTimeSlots(`
-		SELECT id, EXTRACT(HOUR FROM start_time), EXTRACT(HOUR FROM end_time), provider_id
+		SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides
 		FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC
 	`, providerID)
 	if err != nil {
@@ -129,55 +157,85 @@ func newOrdersFromCsv(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 	currProvider.Slots = slots
 
-	orders := []*order{}
+	locales := make([]string, len(records))
+	for i := 1; i < len(records); i++ {
+		if len(records[i]) > 3 {
+			locales[i] = strings.TrimSpace(records[i][3])
+		}
+		if locales[i] != "" && !isSupportedLocale(locales[i]) {
+			http.Error(w, "Unknown locale "+locales[i]+" at line "+strconv.Itoa(i+1), 400)
+			return
+		}
+	}
+
+	blackoutRows := []string{}
+	for i := 1; i < len(records); i++ {
+		onBlackout, err := isBlackoutDate(currProvider.ID, records[i][2])
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if onBlackout {
+			blackoutRows = append(blackoutRows, strconv.Itoa(i+1))
+		}
+	}
+	if len(blackoutRows) > 0 {
+		http.Error(w, "Delivery date falls on a provider blackout at line "+strings.Join(blackoutRows, ", "), 400)
+		return
+	}
 
-	query := "INSERT INTO orders(customer_name, contact_number, delivery_date, provider_id) VALUES"
+	query := "INSERT INTO orders(customer_name, contact_number, delivery_date, provider_id, locale) VALUES"
 	queryParams := []interface{}{}
 	for i := 1; i < len(records); i++ {
 		qI := i - 1
-		query += "($" + strconv.Itoa(qI*4+1) + ", $" + strconv.Itoa(qI*4+2) + ", $" + strconv.Itoa(qI*4+3) + ", $" + strconv.Itoa(qI*4+4) + ")"
+		query += "($" + strconv.Itoa(qI*5+1) + ", $" + strconv.Itoa(qI*5+2) + ", $" + strconv.Itoa(qI*5+3) + ", $" + strconv.Itoa(qI*5+4) + ", $" + strconv.Itoa(qI*5+5) + ")"
 		if i < len(records)-1 {
 			query += ",\n"
 		}
 
-		queryParams = append(queryParams, records[i][0], records[i][1], records[i][2], providerID)
-		orders = append(orders, &order{
-			ContactNumber: records[i][1],
-		})
+		queryParams = append(queryParams, records[i][0], records[i][1], records[i][2], providerID, locales[i])
 	}
+	query += " RETURNING id"
 
-	stmt, err := dbConn.Prepare(query)
+	rows, err := dbConn.Query(query, queryParams...)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	_, err = stmt.Exec(queryParams...)
+	insertedIDs := []int64{}
+	for rows.Next() {
+		var ID int64
+		if err := rows.Scan(&ID); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		insertedIDs = append(insertedIDs, ID)
+	}
+	rows.Close()
+
+	orders, err := fetchOrders(`
+		SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale
+		FROM orders WHERE id = ANY($1) ORDER BY id`,
+		pq.Array(insertedIDs),
+	)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	if len(orders) != len(records)-1 {
+		http.Error(w, "Fail to insert", 500)
+		return
+	}
+	for _, o := range orders {
+		o.Provider = currProvider
+	}
 
-	for i, o := range orders {
-		newlyInsertedOrders, err := fetchOrders(`
-			SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count
-			FROM orders WHERE contact_number = $1 AND NOT deleted`,
-			o.ContactNumber,
-		)
-		if err != nil {
+	for _, o := range orders {
+		if err := scheduleReminder(o); err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		if len(newlyInsertedOrders) <= 0 {
-			http.Error(w, "Fail to insert", 500)
-			return
-		}
-
-		orders[i] = newlyInsertedOrders[0]
-		orders[i].Provider = currProvider
-	}
-
-	for _, o := range orders {
-		go scheduleReminder(o, stopSignal)
 	}
 
 	RenderJSON(w, &map[string]int{})
@@ -186,14 +244,14 @@ func newOrdersFromCsv(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 // GET /api/order/:provider_id
 func getOrdersByProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	providerID, _ := strconv.Atoi(ps.ByName("provider_id"))
-	query := `SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE provider_id = $1 AND NOT deleted`
+	query := `SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE provider_id = $1 AND NOT deleted`
 	orders, err := fetchOrders(query, providerID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	providers, err := fetchProviders(`SELECT id, title, contact_number, reminder_time FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, providerID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -216,6 +274,104 @@ func getOrdersByProvider(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	RenderJSON(w, map[string][]*order{"orders": orders})
 }
 
+// PUT /api/order/:id
+// empty fields are left unchanged.
+// A new delivery date clears the choices, see moveOrderDeliveryDate.
+func updateOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	o := order{}
+	if err := ReadRequestBody(r, &o); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(orders) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	prevDeliveryDate := orders[0].DeliveryDate
+
+	if o.DeliveryDate != "" {
+		if _, err := time.Parse("2006-01-02", o.DeliveryDate); err != nil {
+			http.Error(w, "Invalid date "+o.DeliveryDate, 400)
+			return
+		}
+		onBlackout, err := isBlackoutDate(orders[0].ProviderID, o.DeliveryDate)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if onBlackout {
+			http.Error(w, "Delivery date falls on a provider blackout", 400)
+			return
+		}
+	}
+
+	query := `
+		UPDATE orders SET
+		customer_name = COALESCE(NULLIF($1, ''), customer_name),
+		contact_number = COALESCE(NULLIF($2, ''), contact_number)
+		WHERE id = $3 AND NOT deleted
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	_, err = stmt.Exec(o.CustomerName, o.ContactNumber, ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if o.DeliveryDate != "" && o.DeliveryDate != prevDeliveryDate {
+		if _, err := moveOrderDeliveryDate(orders[0], o.DeliveryDate); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	orders, err = fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE id = $1 AND NOT deleted`, ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(orders) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	o = *orders[0]
+
+	if o.DeliveryDate != prevDeliveryDate {
+		providers, err := fetchProviders(`
+			SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale
+			FROM providers WHERE id = $1 AND NOT deleted`,
+			o.ProviderID,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(providers) == 0 {
+			http.Error(w, "Invalid provider", 400)
+			return
+		}
+		o.Provider = providers[0]
+
+		if err := scheduleReminder(&o); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	RenderJSON(w, o)
+}
+
 // DELETE /api/order/:id
 func deleteOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ID, _ := strconv.Atoi(ps.ByName("id"))
@@ -242,6 +398,11 @@ func deleteOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
+	if err := cancelReminderJobs(int64(ID)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	RenderJSON(w, map[string]string{})
 }
 
@@ -255,7 +416,7 @@ func fetchOrders(query string, args ...interface{}) ([]*order, error) {
 	results := make([]*order, 0)
 	for rows.Next() {
 		o := new(order)
-		err = rows.Scan(&o.ID, &o.CustomerName, &o.ContactNumber, &o.DeliveryDate, &o.ProviderID, &o.RetriesCount)
+		err = rows.Scan(&o.ID, &o.CustomerName, &o.ContactNumber, &o.DeliveryDate, &o.ProviderID, &o.RetriesCount, &o.ConversationState, &o.Code, &o.Locale)
 		if err != nil {
 			return nil, err
 		}
@@ -4,17 +4,23 @@ import (
 	"database/sql"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type provider struct {
-	ID            int64       `json:"id"`
-	Title         string      `json:"title" schema:"title"`
-	ContactNumber string      `json:"contact_number" schema:"contact_number"`
-	ReminderTime  string      `json:"reminder_time" schema:"reminder_time"`
-	Slots         []*timeSlot `json:"slots"`
-	Orders        []*order    `json:"orders"`
+	ID              int64          `json:"id"`
+	Title           string         `json:"title" schema:"title"`
+	ContactNumber   string         `json:"contact_number" schema:"contact_number"`
+	ReminderTime    string         `json:"reminder_time" schema:"reminder_time"`
+	Timezone        string         `json:"timezone" schema:"timezone"`
+	QuietHoursStart *clockTime     `json:"quiet_hours_start" schema:"quiet_hours_start"`
+	QuietHoursEnd   *clockTime     `json:"quiet_hours_end" schema:"quiet_hours_end"`
+	DefaultLocale   string         `json:"default_locale" schema:"default_locale"`
+	Keywords        localeKeywords `json:"-"`
+	Slots           []*timeSlot    `json:"slots"`
+	Orders          []*order       `json:"orders"`
 }
 
 // POST /api/provider
@@ -25,9 +31,24 @@ func createNewProvider(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		return
 	}
 
-	query := `INSERT INTO providers(title, contact_number) VALUES($1, $2) RETURNING id`
+	if p.Timezone == "" {
+		p.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		http.Error(w, "Invalid timezone", 400)
+		return
+	}
+	if p.DefaultLocale == "" {
+		p.DefaultLocale = localeEnglish
+	}
+	if !isSupportedLocale(p.DefaultLocale) {
+		http.Error(w, "Unknown locale "+p.DefaultLocale, 400)
+		return
+	}
+
+	query := `INSERT INTO providers(title, contact_number, timezone, default_locale) VALUES($1, $2, $3, $4) RETURNING id`
 	var id int64
-	err := dbConn.QueryRow(query, p.Title, p.ContactNumber).Scan(&id)
+	err := dbConn.QueryRow(query, p.Title, p.ContactNumber, p.Timezone, p.DefaultLocale).Scan(&id)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -37,6 +58,8 @@ func createNewProvider(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 }
 
 // PUT /api/provider/:id/set_reminder
+// reminder_time is local to the provider timezone, which is left unchanged if empty
+// as is default_locale
 func setProviderReminderTime(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ID, _ := strconv.Atoi(ps.ByName("id"))
 	p := provider{}
@@ -44,15 +67,26 @@ func setProviderReminderTime(w http.ResponseWriter, r *http.Request, ps httprout
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	if _, err := time.LoadLocation(p.Timezone); p.Timezone != "" && err != nil {
+		http.Error(w, "Invalid timezone", 400)
+		return
+	}
+	if p.DefaultLocale != "" && !isSupportedLocale(p.DefaultLocale) {
+		http.Error(w, "Unknown locale "+p.DefaultLocale, 400)
+		return
+	}
 
-	query := `UPDATE providers SET reminder_time = $1 WHERE id = $2`
+	query := `
+		UPDATE providers SET reminder_time = $1, timezone = COALESCE(NULLIF($2, ''), timezone),
+		default_locale = COALESCE(NULLIF($4, ''), default_locale) WHERE id = $3
+	`
 	stmt, err := dbConn.Prepare(query)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	res, err := stmt.Exec(p.ReminderTime, ID)
+	res, err := stmt.Exec(p.ReminderTime, p.Timezone, ID, p.DefaultLocale)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -68,19 +102,24 @@ func setProviderReminderTime(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
+	if err := rescheduleProviderReminders(int64(ID)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	getProviderByID(w, r, ps)
 }
 
 // GET /api/provider
 func getAllProviders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	query := `SELECT id, title, contact_number, reminder_time FROM providers WHERE NOT deleted`
+	query := `SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE NOT deleted`
 	providers, err := fetchProviders(query)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	for _, p := range providers {
-		query := `SELECT id, start_time, end_time, provider_id FROM time_slots WHERE provider_id = $1 AND NOT deleted`
+		query := `SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC`
 		slots, err := fetchTimeSlots(query, p.ID)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -89,7 +128,7 @@ func getAllProviders(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		p.Slots = slots
 
 		query = `
-			SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count
+			SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale
 			FROM orders WHERE provider_id = $1 AND NOT deleted
 		`
 		orders, err := fetchOrders(query, p.ID)
@@ -106,7 +145,7 @@ func getAllProviders(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 // GET /api/provider/:id
 func getProviderByID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	id, _ := strconv.Atoi(ps.ByName("id"))
-	query := `SELECT id, title, contact_number, reminder_time FROM providers WHERE id = $1 AND NOT deleted LIMIT 1`
+	query := `SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted LIMIT 1`
 	providers, err := fetchProviders(query, id)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -118,14 +157,14 @@ func getProviderByID(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	}
 
 	p := providers[0]
-	query = `SELECT id, start_time, end_time, provider_id FROM time_slots WHERE provider_id = $1 AND NOT deleted`
+	query = `SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC`
 	slots, err := fetchTimeSlots(query, p.ID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	p.Slots = slots
-	query = `SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE provider_id = $1 AND NOT deleted`
+	query = `SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale FROM orders WHERE provider_id = $1 AND NOT deleted`
 	orders, err := fetchOrders(query, p.ID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -162,6 +201,11 @@ func deleteProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
+	if err := cancelProviderReminderJobs(int64(id)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	RenderJSON(w, map[string]string{})
 }
 
@@ -176,7 +220,7 @@ func fetchProviders(query string, args ...interface{}) ([]*provider, error) {
 	for rows.Next() {
 		t := new(provider)
 		var reminderTime sql.NullString
-		err = rows.Scan(&t.ID, &t.Title, &t.ContactNumber, &reminderTime)
+		err = rows.Scan(&t.ID, &t.Title, &t.ContactNumber, &reminderTime, &t.Timezone, &t.QuietHoursStart, &t.QuietHoursEnd, &t.DefaultLocale)
 		if err != nil {
 			return nil, err
 		}
@@ -188,3 +232,12 @@ func fetchProviders(query string, args ...interface{}) ([]*provider, error) {
 
 	return results, nil
 }
+
+// location return the timezone the provider operates in, UTC if unknown
+func (p *provider) location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
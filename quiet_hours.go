@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// quietHours is a daily window, in the provider timezone, during which
+// messages that are not answering the customer are held back.
+// The window wraps around midnight when End is before Start, e.g. 21:00-08:00.
+type quietHours struct {
+	Start clockTime
+	End   clockTime
+}
+
+// parseQuietHours accept "HH:MM-HH:MM"
+func parseQuietHours(str string) (*quietHours, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid quiet hours " + str + ", expected HH:MM-HH:MM")
+	}
+	start, err := parseClockTime(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClockTime(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, errors.New("Quiet hours must not start and end at the same time")
+	}
+	return &quietHours{Start: start, End: end}, nil
+}
+
+// globalQuietHours apply to providers without their own, from QUIET_HOURS (e.g. 21:00-08:00).
+// There are none if it is not set.
+func globalQuietHours() *quietHours {
+	str := os.Getenv("QUIET_HOURS")
+	if str == "" {
+		return nil
+	}
+	qh, err := parseQuietHours(str)
+	if err != nil {
+		log.Println("Ignoring QUIET_HOURS:", err.Error())
+		return nil
+	}
+	return qh
+}
+
+// contains report whether c falls in the window, start included and end excluded
+func (qh *quietHours) contains(c clockTime) bool {
+	if qh.Start.Before(qh.End) {
+		return !c.Before(qh.Start) && c.Before(qh.End)
+	}
+	return !c.Before(qh.Start) || c.Before(qh.End)
+}
+
+// nextAllowed return the earliest time from t, in loc, outside of the window
+func (qh *quietHours) nextAllowed(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	if !qh.contains(clockTime{Hour: local.Hour(), Minute: local.Minute()}) {
+		return t
+	}
+
+	end := time.Date(local.Year(), local.Month(), local.Day(), qh.End.Hour, qh.End.Minute, 0, 0, loc)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// lastAllowedBefore return the last minute before the window that t falls in, in loc,
+// or t itself if it is outside of the window
+func (qh *quietHours) lastAllowedBefore(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	if !qh.contains(clockTime{Hour: local.Hour(), Minute: local.Minute()}) {
+		return t
+	}
+
+	start := time.Date(local.Year(), local.Month(), local.Day(), qh.Start.Hour, qh.Start.Minute, 0, 0, loc)
+	if start.After(local) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start.Add(-time.Minute)
+}
+
+// quietHours return the window of the provider, or the global one if it has none
+func (p *provider) quietHours() *quietHours {
+	if p.QuietHoursStart != nil && p.QuietHoursEnd != nil {
+		return &quietHours{Start: *p.QuietHoursStart, End: *p.QuietHoursEnd}
+	}
+	return globalQuietHours()
+}
+
+// PUT /api/provider/:id/quiet_hours
+// quiet_hours_start and quiet_hours_end are local to the provider timezone,
+// both left out to fall back to the global quiet hours
+func setProviderQuietHours(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	p := provider{}
+	if err := ReadRequestBody(r, &p); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if (p.QuietHoursStart == nil) != (p.QuietHoursEnd == nil) {
+		http.Error(w, "Both quiet_hours_start and quiet_hours_end are needed", 400)
+		return
+	}
+	if p.QuietHoursStart != nil && *p.QuietHoursStart == *p.QuietHoursEnd {
+		http.Error(w, "Quiet hours must not start and end at the same time", 400)
+		return
+	}
+
+	query := `UPDATE providers SET quiet_hours_start = $1, quiet_hours_end = $2 WHERE id = $3 AND NOT deleted`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res, err := stmt.Exec(p.QuietHoursStart, p.QuietHoursEnd, ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if rowsAffected <= 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	if err := rescheduleProviderReminders(int64(ID)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	getProviderByID(w, r, ps)
+}
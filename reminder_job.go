@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	jobStatusPending   = "pending"
+	jobStatusRunning   = "running"
+	jobStatusDone      = "done"
+	jobStatusFailed    = "failed"
+	jobStatusCancelled = "cancelled"
+	jobStatusSkipped   = "skipped"
+
+	maxReminderAttempts = 5
+	reminderBatchSize   = 20
+	// a running job older than this is assumed to belong to a crashed worker
+	staleReminderJobAge = 10 * time.Minute
+)
+
+// DeferredFrom is when the job was first due if quiet hours held it back
+type reminderJob struct {
+	ID           int64      `json:"id"`
+	OrderID      int64      `json:"order_id"`
+	RunAt        time.Time  `json:"run_at"`
+	Status       string     `json:"status"`
+	Attempts     int64      `json:"attempts"`
+	LastError    string     `json:"last_error,omitempty"`
+	DeferredFrom *time.Time `json:"deferred_from,omitempty"`
+}
+
+// enqueueReminderJob create the pending reminder of an order
+// or move it to runAt if there is one already.
+// While the reminder of the order is running, runAt is kept as its requeue_at instead,
+// so that it is not sent twice, and queued once it finishes if it differs from its run_at.
+func enqueueReminderJob(orderID int64, runAt time.Time) error {
+	query := `
+		INSERT INTO reminder_jobs(order_id, run_at) VALUES($1, $2)
+		ON CONFLICT (order_id) WHERE status IN ('pending', 'running')
+		DO UPDATE SET
+		run_at = CASE WHEN reminder_jobs.status = 'pending' THEN EXCLUDED.run_at ELSE reminder_jobs.run_at END,
+		deferred_from = CASE WHEN reminder_jobs.status = 'pending' THEN NULL ELSE reminder_jobs.deferred_from END,
+		requeue_at = CASE WHEN reminder_jobs.status = 'running' AND reminder_jobs.run_at <> EXCLUDED.run_at THEN EXCLUDED.run_at END,
+		updated_at = NOW()
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(orderID, runAt)
+	return err
+}
+
+// recordSkippedReminderJob keep track of a reminder that will never be sent and why
+func recordSkippedReminderJob(orderID int64, runAt time.Time, reason string) error {
+	query := `
+		INSERT INTO reminder_jobs(order_id, run_at, status, last_error)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM reminder_jobs WHERE order_id = $1 AND run_at = $2 AND status = $3)
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(orderID, runAt, jobStatusSkipped, reason)
+	return err
+}
+
+// cancelReminderJobs cancel the pending reminders of the given orders
+// and the requeue of their running ones
+func cancelReminderJobs(orderIDs ...int64) error {
+	query := `
+		UPDATE reminder_jobs SET status = CASE WHEN status = $3 THEN $1 ELSE status END, requeue_at = NULL, updated_at = NOW()
+		WHERE order_id = ANY($2) AND status IN ($3, $4)
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(jobStatusCancelled, pq.Array(orderIDs), jobStatusPending, jobStatusRunning)
+	return err
+}
+
+// cancelProviderReminderJobs cancel the pending reminders of every order of a provider
+// and the requeue of their running ones
+func cancelProviderReminderJobs(providerID int64) error {
+	query := `
+		UPDATE reminder_jobs SET status = CASE WHEN status = $2 THEN $1 ELSE status END, requeue_at = NULL, updated_at = NOW()
+		WHERE status IN ($2, $4) AND order_id IN (SELECT id FROM orders WHERE provider_id = $3)
+	`
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(jobStatusCancelled, jobStatusPending, providerID, jobStatusRunning)
+	return err
+}
+
+// claimDueReminderJobs mark up to limit due jobs as running and return them.
+// SKIP LOCKED lets several instances poll the same table without sending twice.
+func claimDueReminderJobs(limit int) ([]*reminderJob, error) {
+	query := `
+		UPDATE reminder_jobs SET status = $1, attempts = attempts + 1, locked_at = NOW(), updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM reminder_jobs
+			WHERE (status = $2 AND run_at <= NOW()) OR (status = $1 AND locked_at < $3)
+			ORDER BY run_at ASC LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, order_id, run_at, status, attempts, last_error, deferred_from
+	`
+	return fetchReminderJobs(query, jobStatusRunning, jobStatusPending, time.Now().Add(-staleReminderJobAge), limit)
+}
+
+// finishReminderJob record the outcome of a claimed job.
+// An empty status is a failed attempt, retried with a linear backoff until maxReminderAttempts.
+// A pending status is a job deferred to j.RunAt, which does not count as an attempt.
+// Otherwise jobErr is kept as the reason of the final status.
+// A reminder rescheduled while the job ran is then queued, see enqueueReminderJob.
+func finishReminderJob(j *reminderJob, status string, jobErr error) error {
+	var requeueAt pq.NullTime
+	var err error
+	if status == jobStatusPending {
+		requeueAt, err = deferReminderJob(j)
+	} else {
+		requeueAt, err = completeReminderJob(j, status, jobErr)
+	}
+	if err != nil || !requeueAt.Valid {
+		return err
+	}
+	return enqueueReminderJob(j.OrderID, requeueAt.Time)
+}
+
+// completeReminderJob record the outcome of a job that was not deferred
+// and return when it is to be queued again, if ever
+func completeReminderJob(j *reminderJob, status string, jobErr error) (pq.NullTime, error) {
+	runAt := j.RunAt
+	var lastError sql.NullString
+	if jobErr != nil {
+		lastError = sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+	if status == "" {
+		status = jobStatusPending
+		runAt = time.Now().Add(time.Minute * time.Duration(j.Attempts))
+		if j.Attempts >= maxReminderAttempts {
+			status = jobStatusFailed
+		}
+	}
+
+	return setReminderJobStatus(j.ID, status, runAt, lastError)
+}
+
+// setReminderJobStatus return the requeue_at the job had, now cleared
+func setReminderJobStatus(jobID int64, status string, runAt time.Time, lastError sql.NullString) (pq.NullTime, error) {
+	query := `
+		UPDATE reminder_jobs SET status = $2, run_at = $3, last_error = $4, locked_at = NULL, requeue_at = NULL, updated_at = NOW()
+		FROM (SELECT id, requeue_at FROM reminder_jobs WHERE id = $1 FOR UPDATE) old
+		WHERE reminder_jobs.id = old.id
+		RETURNING old.requeue_at
+	`
+	var requeueAt pq.NullTime
+	err := dbConn.QueryRow(query, jobID, status, runAt, lastError).Scan(&requeueAt)
+	return requeueAt, err
+}
+
+// deferReminderJob return the requeue_at the job had, now cleared
+func deferReminderJob(j *reminderJob) (pq.NullTime, error) {
+	query := `
+		UPDATE reminder_jobs SET status = $2, run_at = $3, deferred_from = $4,
+		attempts = attempts - 1, locked_at = NULL, requeue_at = NULL, updated_at = NOW()
+		FROM (SELECT id, requeue_at FROM reminder_jobs WHERE id = $1 FOR UPDATE) old
+		WHERE reminder_jobs.id = old.id
+		RETURNING old.requeue_at
+	`
+	var requeueAt pq.NullTime
+	err := dbConn.QueryRow(query, j.ID, jobStatusPending, j.RunAt, j.DeferredFrom).Scan(&requeueAt)
+	return requeueAt, err
+}
+
+// processDueReminderJobs send every reminder that is due
+func processDueReminderJobs() {
+	for {
+		jobs, err := claimDueReminderJobs(reminderBatchSize)
+		if err != nil {
+			log.Println("Failed to claim reminder jobs:", err.Error())
+			return
+		}
+
+		for _, j := range jobs {
+			status, jobErr := runReminderJob(j)
+			if err := finishReminderJob(j, status, jobErr); err != nil {
+				log.Println("Failed to update reminder job", j.ID, ":", err.Error())
+			}
+		}
+
+		if len(jobs) < reminderBatchSize {
+			return
+		}
+	}
+}
+
+// reminderGracePeriod is how late a reminder may still be sent,
+// REMINDER_GRACE_MINUTES or 6 hours by default
+func reminderGracePeriod() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("REMINDER_GRACE_MINUTES"))
+	if err != nil || minutes < 0 {
+		return 6 * time.Hour
+	}
+	return time.Minute * time.Duration(minutes)
+}
+
+// reminderSkipReason tell why a reminder due at runAt should not be sent anymore
+// or return an empty string if it can still go out.
+// deliveryDate must be in format of 'YYYY-MM-DD' and starts at midnight in loc.
+func reminderSkipReason(runAt time.Time, deliveryDate string, loc *time.Location, now time.Time) string {
+	deliveryStart, err := generateGoDateFromString(deliveryDate, "0", loc)
+	if err != nil {
+		return "Invalid delivery date " + deliveryDate
+	}
+	if !now.Before(deliveryStart) {
+		return "Delivery date " + deliveryDate + " has already started"
+	}
+	if late := now.Sub(runAt); late > reminderGracePeriod() {
+		return "Overdue by " + late.Round(time.Minute).String() + ", beyond the grace period of " + reminderGracePeriod().String()
+	}
+	return ""
+}
+
+// catchUpMissedReminders go through the reminders that fell due while the service was down.
+// The ones still worth sending are left for the worker, the others are marked as skipped.
+func catchUpMissedReminders() {
+	query := `
+		SELECT reminder_jobs.id, to_char(orders.delivery_date, 'YYYY-MM-DD'), providers.timezone, reminder_jobs.run_at
+		FROM reminder_jobs
+		INNER JOIN orders ON orders.id = reminder_jobs.order_id
+		INNER JOIN providers ON providers.id = orders.provider_id
+		WHERE reminder_jobs.status = $1 AND reminder_jobs.run_at < NOW()
+	`
+	rows, err := dbConn.Query(query, jobStatusPending)
+	if err != nil {
+		log.Println("Failed to look for missed reminders:", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	skipped := map[int64]string{}
+	overdue := 0
+	for rows.Next() {
+		var jobID int64
+		var deliveryDate string
+		p := new(provider)
+		var runAt time.Time
+		if err := rows.Scan(&jobID, &deliveryDate, &p.Timezone, &runAt); err != nil {
+			log.Println("Failed to look for missed reminders:", err.Error())
+			return
+		}
+		overdue++
+		if reason := reminderSkipReason(runAt, deliveryDate, p.location(), now); reason != "" {
+			skipped[jobID] = reason
+		}
+	}
+	rows.Close()
+
+	stmt, err := dbConn.Prepare(`UPDATE reminder_jobs SET status = $2, last_error = $3, updated_at = NOW() WHERE id = $1 AND status = $4`)
+	if err != nil {
+		log.Println("Failed to skip missed reminders:", err.Error())
+		return
+	}
+	for jobID, reason := range skipped {
+		if _, err := stmt.Exec(jobID, jobStatusSkipped, reason, jobStatusPending); err != nil {
+			log.Println("Failed to skip reminder job", jobID, ":", err.Error())
+			continue
+		}
+		log.Println("Skipped reminder job", jobID, ":", reason)
+	}
+	log.Println("Catching up", overdue-len(skipped), "missed reminders, skipped", len(skipped))
+}
+
+func fetchReminderJobs(query string, args ...interface{}) ([]*reminderJob, error) {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*reminderJob, 0)
+	for rows.Next() {
+		j := new(reminderJob)
+		var lastError sql.NullString
+		err = rows.Scan(&j.ID, &j.OrderID, &j.RunAt, &j.Status, &j.Attempts, &lastError, &j.DeferredFrom)
+		if err != nil {
+			return nil, err
+		}
+		j.LastError = lastError.String
+
+		results = append(results, j)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+)
+
+// routeReply find which order an inbound sms is about.
+// A customer can have several orders in progress, so the reply is routed by:
+// 1. an order code at the start of the body, which is stripped from s.Body
+// 2. the only order whose conversation still expects an answer
+// 3. the order the customer was last texted about
+// If several conversations expect an answer, the customer is asked which delivery
+// they mean instead and asked is true.
+// The order returned has Provider populated, nil if the number has no order.
+func routeReply(s *sms) (o *order, asked bool, err error) {
+	query := `
+		SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count, conversation_state, code, locale
+		FROM orders WHERE contact_number = $1 AND NOT deleted
+		ORDER BY (
+			SELECT MAX(created_at) FROM messages WHERE messages.order_id = orders.id AND messages.direction = $2
+		) DESC NULLS LAST, delivery_date DESC
+	`
+	orders, err := fetchOrders(query, s.From, directionOutbound)
+	if err != nil || len(orders) == 0 {
+		return nil, false, err
+	}
+	if err := populateProviders(orders); err != nil {
+		return nil, false, err
+	}
+
+	if fields := strings.Fields(s.Body); len(fields) > 0 {
+		for _, o := range orders {
+			if strings.EqualFold(fields[0], o.Code) {
+				s.Body = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s.Body), fields[0]))
+				return o, false, nil
+			}
+		}
+	}
+	if len(orders) == 1 {
+		return orders[0], false, nil
+	}
+
+	awaiting, err := ordersAwaitingAnswer(orders)
+	if err != nil {
+		return nil, false, err
+	}
+	// keywords like STOP or HELP do not need to be about a given order
+	if len(awaiting) > 1 {
+		if _, ok := keywordHandlers[awaiting[0].Provider.Keywords.intentOf(s.Body, awaiting[0].locale())]; ok {
+			return awaiting[0], false, nil
+		}
+		_, err := sendWhichOrderSms(s.From, awaiting)
+		return nil, true, err
+	}
+	if len(awaiting) == 1 {
+		return awaiting[0], false, nil
+	}
+	return orders[0], false, nil
+}
+
+// ordersAwaitingAnswer keep the orders that were texted and whose
+// conversation expects slots from the customer, on an upcoming delivery
+func ordersAwaitingAnswer(orders []*order) ([]*order, error) {
+	awaiting := []*order{}
+	for _, o := range orders {
+		if o.ConversationState != stateAwaitingChoice && o.ConversationState != stateAwaitingCorrection {
+			continue
+		}
+		past, err := isPastDelivery(o)
+		if err != nil {
+			return nil, err
+		}
+		if past {
+			continue
+		}
+
+		var texted bool
+		query := `SELECT EXISTS (SELECT 1 FROM messages WHERE order_id = $1 AND direction = $2)`
+		if err := dbConn.QueryRow(query, o.ID, directionOutbound).Scan(&texted); err != nil {
+			return nil, err
+		}
+		if texted {
+			awaiting = append(awaiting, o)
+		}
+	}
+	return awaiting, nil
+}
+
+// populateProviders set the Provider of every order, with Keywords
+func populateProviders(orders []*order) error {
+	for _, o := range orders {
+		providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1`, o.ProviderID)
+		if err != nil {
+			return err
+		}
+		if len(providers) == 0 {
+			o.Provider = &provider{ID: o.ProviderID}
+			continue
+		}
+		o.Provider = providers[0]
+
+		o.Provider.Keywords, err = fetchKeywords(o.ProviderID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
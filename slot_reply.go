@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var slotReplySeparator = regexp.MustCompile(`[\s,;]+`)
+var slotReplyDash = regexp.MustCompile(`\s*-\s*`)
+var slotReplyRange = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+// why a reply could not be read as slot numbers
+const (
+	slotReplyEmpty      = "empty"
+	slotReplyNoNumber   = "no_number"
+	slotReplyNotASlot   = "not_a_slot"
+	slotReplyNotARange  = "not_a_range"
+	slotReplyNotANumber = "not_a_number"
+)
+
+// slotReplyReasons explain each reason to customers, by locale.
+// %s is the part of the reply at fault.
+var slotReplyReasons = map[string]map[string]string{
+	localeEnglish: {
+		slotReplyEmpty:      "Your reply is empty",
+		slotReplyNoNumber:   "No time slot number found in your reply",
+		slotReplyNotASlot:   "%s is not one of the time slots",
+		slotReplyNotARange:  "%s is not a range of the time slots",
+		slotReplyNotANumber: "\"%s\" is not a time slot number",
+	},
+	localeMalay: {
+		slotReplyEmpty:      "Balasan anda kosong",
+		slotReplyNoNumber:   "Tiada nombor slot masa dalam balasan anda",
+		slotReplyNotASlot:   "%s bukan salah satu slot masa",
+		slotReplyNotARange:  "%s bukan julat slot masa",
+		slotReplyNotANumber: "\"%s\" bukan nombor slot masa",
+	},
+	localeIndonesian: {
+		slotReplyEmpty:      "Balasan Anda kosong",
+		slotReplyNoNumber:   "Tidak ada nomor slot waktu dalam balasan Anda",
+		slotReplyNotASlot:   "%s bukan salah satu slot waktu",
+		slotReplyNotARange:  "%s bukan rentang slot waktu",
+		slotReplyNotANumber: "\"%s\" bukan nomor slot waktu",
+	},
+	localeChinese: {
+		slotReplyEmpty:      "您的回复为空",
+		slotReplyNoNumber:   "您的回复中没有时间段数字",
+		slotReplyNotASlot:   "%s 不是可选的时间段",
+		slotReplyNotARange:  "%s 不是有效的时间段范围",
+		slotReplyNotANumber: "“%s” 不是时间段数字",
+	},
+}
+
+// slotReplyError tell why a reply could not be read, Value being the part of it at fault
+type slotReplyError struct {
+	Reason string
+	Value  string
+}
+
+func (e *slotReplyError) Error() string {
+	return e.localized(localeEnglish)
+}
+
+// localized explain the error to a customer of locale, in English for unknown locales
+func (e *slotReplyError) localized(locale string) string {
+	reasons, ok := slotReplyReasons[locale]
+	if !ok {
+		reasons = slotReplyReasons[localeEnglish]
+	}
+	if e.Value == "" {
+		return reasons[e.Reason]
+	}
+	return fmt.Sprintf(reasons[e.Reason], e.Value)
+}
+
+// parseSlotReply read the slot numbers a customer replied with.
+// Numbers are 1-based as shown in the menu, separated by spaces and/or commas.
+// "2-4" picks a range and "all" picks every slot.
+// slotCount is the number of slots the menu is numbered against.
+// The chosen numbers are returned once each in the order given,
+// otherwise the error is a *slotReplyError explaining to the customer what is wrong.
+func parseSlotReply(body string, slotCount int) ([]int, error) {
+	body = strings.ToLower(strings.TrimSpace(body))
+	if body == "" {
+		return nil, &slotReplyError{Reason: slotReplyEmpty}
+	}
+	if body == "all" {
+		chosen := []int{}
+		for n := 1; n <= slotCount; n++ {
+			chosen = append(chosen, n)
+		}
+		return chosen, nil
+	}
+
+	// allow spaces around range dashes, e.g. "1 - 3"
+	body = slotReplyDash.ReplaceAllString(body, "-")
+
+	chosen := []int{}
+	seen := map[int]bool{}
+	add := func(n int) error {
+		if n < 1 || n > slotCount {
+			return &slotReplyError{Reason: slotReplyNotASlot, Value: strconv.Itoa(n)}
+		}
+		if !seen[n] {
+			seen[n] = true
+			chosen = append(chosen, n)
+		}
+		return nil
+	}
+
+	for _, token := range slotReplySeparator.Split(body, -1) {
+		if token == "" {
+			continue
+		}
+
+		if match := slotReplyRange.FindStringSubmatch(token); match != nil {
+			from, _ := strconv.Atoi(match[1])
+			to, _ := strconv.Atoi(match[2])
+			if from > to {
+				from, to = to, from
+			}
+			if from < 1 || to > slotCount {
+				return nil, &slotReplyError{Reason: slotReplyNotARange, Value: token}
+			}
+			for n := from; n <= to; n++ {
+				add(n)
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, &slotReplyError{Reason: slotReplyNotANumber, Value: token}
+		}
+		if err := add(n); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(chosen) == 0 {
+		return nil, &slotReplyError{Reason: slotReplyNoNumber}
+	}
+	return chosen, nil
+}
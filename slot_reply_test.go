@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSlotReply(t *testing.T) {
+	tests := []struct {
+		body      string
+		slotCount int
+		want      []int
+		wantErr   string
+	}{
+		{body: "1", slotCount: 3, want: []int{1}},
+		{body: " 2 ", slotCount: 3, want: []int{2}},
+		{body: "1,3", slotCount: 3, want: []int{1, 3}},
+		{body: "3 1", slotCount: 3, want: []int{3, 1}},
+		{body: "1; 2", slotCount: 3, want: []int{1, 2}},
+		{body: "1, ,2", slotCount: 3, want: []int{1, 2}},
+		{body: "2-4", slotCount: 4, want: []int{2, 3, 4}},
+		{body: "1 - 3", slotCount: 3, want: []int{1, 2, 3}},
+		{body: "3-1", slotCount: 3, want: []int{1, 2, 3}},
+		{body: "1-2, 4", slotCount: 4, want: []int{1, 2, 4}},
+		{body: "all", slotCount: 3, want: []int{1, 2, 3}},
+		{body: "ALL", slotCount: 2, want: []int{1, 2}},
+		{body: "1,1,2", slotCount: 3, want: []int{1, 2}},
+		{body: "1-3,2", slotCount: 3, want: []int{1, 2, 3}},
+		{body: "2 1-2", slotCount: 3, want: []int{2, 1}},
+		{body: "", slotCount: 3, wantErr: "Your reply is empty"},
+		{body: "   ", slotCount: 3, wantErr: "Your reply is empty"},
+		{body: ",,", slotCount: 3, wantErr: "No time slot number found in your reply"},
+		{body: "0", slotCount: 3, wantErr: "0 is not one of the time slots"},
+		{body: "4", slotCount: 3, wantErr: "4 is not one of the time slots"},
+		{body: "1,4", slotCount: 3, wantErr: "4 is not one of the time slots"},
+		{body: "2-5", slotCount: 3, wantErr: "2-5 is not a range of the time slots"},
+		{body: "0-2", slotCount: 3, wantErr: "0-2 is not a range of the time slots"},
+		{body: "one", slotCount: 3, wantErr: "\"one\" is not a time slot number"},
+		{body: "1 and 2", slotCount: 3, wantErr: "\"and\" is not a time slot number"},
+		{body: "-1", slotCount: 3, wantErr: "-1 is not one of the time slots"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSlotReply(tt.body, tt.slotCount)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseSlotReply(%q, %d) error = %v, want %q", tt.body, tt.slotCount, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSlotReply(%q, %d) unexpected error %v", tt.body, tt.slotCount, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSlotReply(%q, %d) = %v, want %v", tt.body, tt.slotCount, got, tt.want)
+		}
+	}
+}
+
+func TestSlotReplyErrorLocalized(t *testing.T) {
+	tests := []struct {
+		body   string
+		locale string
+		want   string
+	}{
+		{"4", localeMalay, "4 bukan salah satu slot masa"},
+		{"2-5", localeIndonesian, "2-5 bukan rentang slot waktu"},
+		{"one", localeChinese, "“one” 不是时间段数字"},
+		{"", localeChinese, "您的回复为空"},
+		{"4", "fr", "4 is not one of the time slots"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseSlotReply(tt.body, 3)
+		replyErr, ok := err.(*slotReplyError)
+		if !ok {
+			t.Errorf("parseSlotReply(%q) error = %v, want a *slotReplyError", tt.body, err)
+			continue
+		}
+		if got := replyErr.localized(tt.locale); got != tt.want {
+			t.Errorf("parseSlotReply(%q) error in %s = %q, want %q", tt.body, tt.locale, got, tt.want)
+		}
+	}
+
+	// every reason is explained in every locale
+	for _, locale := range supportedLocales {
+		for reason := range slotReplyReasons[localeEnglish] {
+			if slotReplyReasons[locale][reason] == "" {
+				t.Errorf("reason %s has no %s explanation", reason, locale)
+			}
+		}
+	}
+}
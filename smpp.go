@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// SMPP 3.4 command ids
+const (
+	smppGenericNack         = 0x80000000
+	smppBindTransceiver     = 0x00000009
+	smppBindTransceiverResp = 0x80000009
+	smppSubmitSm            = 0x00000004
+	smppSubmitSmResp        = 0x80000004
+	smppDeliverSm           = 0x00000005
+	smppDeliverSmResp       = 0x80000005
+	smppUnbind              = 0x00000006
+	smppUnbindResp          = 0x80000006
+	smppEnquireLink         = 0x00000015
+	smppEnquireLinkResp     = 0x80000015
+)
+
+// SMPP 3.4 command statuses
+const (
+	smppStatusOK         = 0x00
+	smppStatusInvalidCmd = 0x03
+	smppStatusSysErr     = 0x08
+	smppStatusMsgQFull   = 0x14
+	smppStatusThrottled  = 0x58
+	smppStatusTempAppErr = 0x64
+)
+
+const (
+	smppDataCodingDefault = 0x00
+	smppDataCodingIA5     = 0x01
+	smppDataCodingLatin1  = 0x03
+	smppDataCodingUCS2    = 0x08
+
+	smppEsmClassReceipt = 0x04
+	smppEsmClassUDHI    = 0x40
+
+	smppTagReceiptedMessageID = 0x001E
+	smppTagMessageState       = 0x0427
+)
+
+// smppPDU is a command or response exchanged with the SMSC
+type smppPDU struct {
+	CommandID uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// readSmppPDU read the next PDU from r
+func readSmppPDU(r io.Reader) (*smppPDU, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 16 || length > 64*1024 {
+		return nil, fmt.Errorf("Invalid SMPP PDU length %d", length)
+	}
+
+	p := &smppPDU{
+		CommandID: binary.BigEndian.Uint32(header[4:8]),
+		Status:    binary.BigEndian.Uint32(header[8:12]),
+		Sequence:  binary.BigEndian.Uint32(header[12:16]),
+		Body:      make([]byte, length-16),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// bytes return the PDU as sent on the wire
+func (p *smppPDU) bytes() []byte {
+	b := make([]byte, 16, 16+len(p.Body))
+	binary.BigEndian.PutUint32(b[0:4], uint32(16+len(p.Body)))
+	binary.BigEndian.PutUint32(b[4:8], p.CommandID)
+	binary.BigEndian.PutUint32(b[8:12], p.Status)
+	binary.BigEndian.PutUint32(b[12:16], p.Sequence)
+	return append(b, p.Body...)
+}
+
+// smppReader read a PDU body field by field, remembering the first error
+type smppReader struct {
+	b   []byte
+	err error
+}
+
+func (r *smppReader) cString() string {
+	if r.err != nil {
+		return ""
+	}
+	idx := bytes.IndexByte(r.b, 0)
+	if idx < 0 {
+		r.err = errors.New("Unterminated SMPP string")
+		return ""
+	}
+	str := string(r.b[:idx])
+	r.b = r.b[idx+1:]
+	return str
+}
+
+func (r *smppReader) octet() byte {
+	b := r.octets(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *smppReader) octets(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("Truncated SMPP PDU")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// tlvs read the optional parameters that end a body
+func (r *smppReader) tlvs() map[uint16][]byte {
+	tlvs := map[uint16][]byte{}
+	for r.err == nil && len(r.b) >= 4 {
+		tag := binary.BigEndian.Uint16(r.b[0:2])
+		length := int(binary.BigEndian.Uint16(r.b[2:4]))
+		r.b = r.b[4:]
+		tlvs[tag] = r.octets(length)
+	}
+	return tlvs
+}
+
+// smppShortMessage is a submit_sm or deliver_sm, which share their layout
+type smppShortMessage struct {
+	SourceTON          byte
+	SourceNPI          byte
+	Source             string
+	DestTON            byte
+	DestNPI            byte
+	Destination        string
+	EsmClass           byte
+	RegisteredDelivery byte
+	DataCoding         byte
+	Message            []byte
+	TLVs               map[uint16][]byte
+}
+
+// encode return the PDU body of sm, without optional parameters
+func (sm *smppShortMessage) encode() []byte {
+	b := &bytes.Buffer{}
+	b.WriteByte(0) // service_type
+	b.WriteByte(sm.SourceTON)
+	b.WriteByte(sm.SourceNPI)
+	b.WriteString(sm.Source + "\x00")
+	b.WriteByte(sm.DestTON)
+	b.WriteByte(sm.DestNPI)
+	b.WriteString(sm.Destination + "\x00")
+	b.WriteByte(sm.EsmClass)
+	b.WriteByte(0) // protocol_id
+	b.WriteByte(0) // priority_flag
+	b.WriteByte(0) // schedule_delivery_time
+	b.WriteByte(0) // validity_period
+	b.WriteByte(sm.RegisteredDelivery)
+	b.WriteByte(0) // replace_if_present_flag
+	b.WriteByte(sm.DataCoding)
+	b.WriteByte(0) // sm_default_msg_id
+	b.WriteByte(byte(len(sm.Message)))
+	b.Write(sm.Message)
+	return b.Bytes()
+}
+
+// parseSmppShortMessage read the body of a submit_sm or deliver_sm
+func parseSmppShortMessage(body []byte) (*smppShortMessage, error) {
+	r := &smppReader{b: body}
+	sm := &smppShortMessage{}
+	r.cString() // service_type
+	sm.SourceTON = r.octet()
+	sm.SourceNPI = r.octet()
+	sm.Source = r.cString()
+	sm.DestTON = r.octet()
+	sm.DestNPI = r.octet()
+	sm.Destination = r.cString()
+	sm.EsmClass = r.octet()
+	r.octet()   // protocol_id
+	r.octet()   // priority_flag
+	r.cString() // schedule_delivery_time
+	r.cString() // validity_period
+	sm.RegisteredDelivery = r.octet()
+	r.octet() // replace_if_present_flag
+	sm.DataCoding = r.octet()
+	r.octet() // sm_default_msg_id
+	sm.Message = r.octets(int(r.octet()))
+	sm.TLVs = r.tlvs()
+	return sm, r.err
+}
+
+// gsm7Codes give the GSM 03.38 code of every character of gsm7Basic,
+// which leaves out the escape code 0x1B
+var gsm7Codes = func() map[rune]byte {
+	codes := map[rune]byte{}
+	code := byte(0)
+	for _, r := range gsm7Basic {
+		if code == 0x1B {
+			code++
+		}
+		codes[r] = code
+		code++
+	}
+	return codes
+}()
+
+// gsm7ExtensionCodes follow the escape code 0x1B
+var gsm7ExtensionCodes = map[rune]byte{
+	'\f': 0x0A, '^': 0x14, '{': 0x28, '}': 0x29, '\\': 0x2F,
+	'[': 0x3C, '~': 0x3D, ']': 0x3E, '|': 0x40, '€': 0x65,
+}
+
+// gsm7Encode return the unpacked septets of r, one per octet as SMPP expects for the default alphabet.
+// r must be a GSM-7 character.
+func gsm7Encode(r rune) []byte {
+	if code, ok := gsm7ExtensionCodes[r]; ok {
+		return []byte{0x1B, code}
+	}
+	return []byte{gsm7Codes[r]}
+}
+
+// gsm7Chars and gsm7ExtensionChars give the character of every GSM 03.38 code
+var gsm7Chars, gsm7ExtensionChars = reverseGsm7Codes(gsm7Codes), reverseGsm7Codes(gsm7ExtensionCodes)
+
+func reverseGsm7Codes(codes map[rune]byte) map[byte]rune {
+	chars := map[byte]rune{}
+	for r, code := range codes {
+		chars[code] = r
+	}
+	return chars
+}
+
+// gsm7Decode turn unpacked septets back into text.
+// An escape ending the text is dropped, and one followed by a code that is no
+// extension character reads as that code alone, as GSM 03.38 recommends.
+func gsm7Decode(b []byte) string {
+	runes := []rune{}
+	for i := 0; i < len(b); i++ {
+		code := b[i] & 0x7F
+		if code == 0x1B {
+			if i+1 >= len(b) {
+				break
+			}
+			i++
+			code = b[i] & 0x7F
+			if r, ok := gsm7ExtensionChars[code]; ok {
+				runes = append(runes, r)
+				continue
+			}
+		}
+		if r, ok := gsm7Chars[code]; ok {
+			runes = append(runes, r)
+		}
+	}
+	return string(runes)
+}
+
+// smppParts split body into the short messages to submit along with their data coding.
+// Several parts each start with a concatenation header numbered with ref,
+// and are split the same way as encodeSms counts segments.
+func smppParts(body string, ref byte) (byte, [][]byte) {
+	dataCoding := byte(smppDataCodingDefault)
+	single, multi := 160, 153
+	encode := gsm7Encode
+	if encodeSms(body).Encoding == encodingUCS2 {
+		dataCoding = smppDataCodingUCS2
+		single, multi = 140, 134
+		encode = func(r rune) []byte {
+			b := []byte{}
+			for _, u := range utf16.Encode([]rune{r}) {
+				b = append(b, byte(u>>8), byte(u))
+			}
+			return b
+		}
+	}
+
+	chars := [][]byte{}
+	length := 0
+	for _, r := range body {
+		chars = append(chars, encode(r))
+		length += len(chars[len(chars)-1])
+	}
+	if length <= single {
+		return dataCoding, [][]byte{bytes.Join(chars, nil)}
+	}
+
+	parts := [][]byte{{}}
+	for _, c := range chars {
+		if len(parts[len(parts)-1])+len(c) > multi {
+			parts = append(parts, []byte{})
+		}
+		parts[len(parts)-1] = append(parts[len(parts)-1], c...)
+	}
+	for i, part := range parts {
+		udh := []byte{0x05, 0x00, 0x03, ref, byte(len(parts)), byte(i + 1)}
+		parts[i] = append(udh, part...)
+	}
+	return dataCoding, parts
+}
+
+// parseConcatUDH strip the user data header from a short message and
+// return the concatenation it tells about, total is 0 if it is not part of a concatenated message
+func parseConcatUDH(msg []byte) (ref, total, seq int, rest []byte, err error) {
+	if len(msg) == 0 || len(msg) < 1+int(msg[0]) {
+		return 0, 0, 0, nil, errors.New("Truncated user data header")
+	}
+	udh, rest := msg[1:1+int(msg[0])], msg[1+int(msg[0]):]
+
+	for len(udh) >= 2 {
+		iei, length := udh[0], int(udh[1])
+		if len(udh) < 2+length {
+			break
+		}
+		ie := udh[2 : 2+length]
+		switch {
+		case iei == 0x00 && length == 3:
+			ref, total, seq = int(ie[0]), int(ie[1]), int(ie[2])
+		case iei == 0x08 && length == 4:
+			ref, total, seq = int(ie[0])<<8|int(ie[1]), int(ie[2]), int(ie[3])
+		}
+		udh = udh[2+length:]
+	}
+	return ref, total, seq, rest, nil
+}
+
+// decodeSmppText turn a short message into text according to its data coding
+func decodeSmppText(b []byte, dataCoding byte) string {
+	switch dataCoding {
+	case smppDataCodingUCS2:
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(units))
+	case smppDataCodingLatin1:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	case smppDataCodingIA5:
+		return string(b)
+	}
+	return gsm7Decode(b)
+}
+
+// smppReceiptStates name the message_state values of delivery receipts as their text does
+var smppReceiptStates = map[byte]string{
+	1: "ENROUTE", 2: "DELIVRD", 3: "EXPIRED", 4: "DELETED",
+	5: "UNDELIV", 6: "ACCEPTD", 7: "UNKNOWN", 8: "REJECTD",
+}
+
+// parseSmppReceipt return the message ID, normalized by smppMessageID, final state
+// and error code a delivery receipt is about.
+// The receipted_message_id and message_state parameters are used when given, the text
+// "id:IIII sub:001 dlvrd:001 submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DELIVRD err:000" otherwise.
+// decimalText tells that the SMSC gives the text ID in decimal, which is then converted
+// to the hexadecimal ID of submit_sm_resp.
+func parseSmppReceipt(sm *smppShortMessage, decimalText bool) (id, stat, errCode string) {
+	for _, field := range strings.Fields(string(sm.Message)) {
+		switch {
+		case strings.HasPrefix(field, "id:"):
+			id = strings.TrimPrefix(field, "id:")
+			if n, err := strconv.ParseUint(id, 10, 64); decimalText && err == nil {
+				id = strconv.FormatUint(n, 16)
+			}
+		case strings.HasPrefix(field, "stat:"):
+			stat = strings.TrimPrefix(field, "stat:")
+		case strings.HasPrefix(field, "err:"):
+			errCode = strings.TrimPrefix(field, "err:")
+		}
+	}
+	if v, ok := sm.TLVs[smppTagReceiptedMessageID]; ok {
+		id = strings.TrimRight(string(v), "\x00")
+	}
+	if v, ok := sm.TLVs[smppTagMessageState]; ok && len(v) == 1 {
+		stat = smppReceiptStates[v[0]]
+	}
+	return smppMessageID(id), stat, errCode
+}
+
+// smppMessageID normalize the case and leading zeros of a message ID,
+// which receipts do not always give the same way as submit_sm_resp
+func smppMessageID(id string) string {
+	normalized := strings.TrimLeft(strings.ToUpper(id), "0")
+	if normalized == "" && id != "" {
+		return "0"
+	}
+	return normalized
+}
+
+// smppAddress return the type of number, numbering plan and digits to send addr with:
+// international for +E.164 numbers, alphanumeric for sender names
+func smppAddress(addr string) (byte, byte, string) {
+	if strings.HasPrefix(addr, "+") {
+		return 1, 1, strings.TrimPrefix(addr, "+")
+	}
+	if strings.Trim(addr, "0123456789") == "" {
+		return 0, 1, addr
+	}
+	return 5, 0, addr
+}
+
+// smppNumber return an address received from the SMSC in the format of order contact numbers
+func smppNumber(ton byte, addr string) string {
+	if ton == 1 && !strings.HasPrefix(addr, "+") {
+		return "+" + addr
+	}
+	return addr
+}
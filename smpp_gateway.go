@@ -0,0 +1,504 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// smppGateway send sms over an SMPP 3.4 transceiver bind to an SMSC or aggregator,
+// which delivers replies and delivery receipts over the same bind.
+// Configured by SMPP_ADDR (host:port), SMPP_SYSTEM_ID, SMPP_PASSWORD, SMPP_SYSTEM_TYPE
+// and SMPP_SOURCE_ADDR, the number or sender name messages are sent from.
+// SMPP_RECEIPT_IDS is set to "decimal" for SMSCs whose receipt text gives message IDs
+// in decimal rather than in the hexadecimal of submit_sm_resp.
+// The bind is checked with enquire_link every SMPP_ENQUIRE_SECONDS (30 by default)
+// and established again whenever it is lost.
+type smppGateway struct {
+	addr       string
+	systemID   string
+	password   string
+	systemType string
+	sourceAddr string
+	enquire    time.Duration
+	// decimalReceiptIDs is set by SMPP_RECEIPT_IDS=decimal
+	decimalReceiptIDs bool
+
+	mu       sync.Mutex
+	conn     net.Conn // nil while not bound
+	dialed   net.Conn // connection of the current session, bound or not
+	closed   chan struct{}
+	sequence uint32
+	ref      byte
+	pending  map[uint32]chan *smppPDU
+	concats  map[string]*smppConcat
+
+	writeMu sync.Mutex
+}
+
+// smppConcat collect the parts of a long inbound message
+type smppConcat struct {
+	parts     [][]byte
+	startedAt time.Time
+}
+
+// smppRetryableStatuses are submit_sm failures of the SMSC itself
+var smppRetryableStatuses = map[uint32]bool{
+	smppStatusSysErr:    true,
+	smppStatusMsgQFull:  true,
+	smppStatusThrottled: true,
+}
+
+// smppReceiptStatuses map delivery receipt states to the Twilio statuses used in the message log
+var smppReceiptStatuses = map[string]string{
+	"ENROUTE": "sent",
+	"ACCEPTD": "sent",
+	"UNKNOWN": "sent",
+	"DELIVRD": messageStatusDelivered,
+	"EXPIRED": messageStatusUndelivered,
+	"UNDELIV": messageStatusUndelivered,
+	"DELETED": messageStatusFailed,
+	"REJECTD": messageStatusFailed,
+}
+
+const smppTimeout = 30 * time.Second
+
+// newSmppGateway start binding to SMPP_ADDR in the background
+func newSmppGateway() (*smppGateway, error) {
+	g := &smppGateway{
+		addr:       os.Getenv("SMPP_ADDR"),
+		systemID:   os.Getenv("SMPP_SYSTEM_ID"),
+		password:   os.Getenv("SMPP_PASSWORD"),
+		systemType: os.Getenv("SMPP_SYSTEM_TYPE"),
+		sourceAddr: os.Getenv("SMPP_SOURCE_ADDR"),
+		enquire:    30 * time.Second,
+		pending:    map[uint32]chan *smppPDU{},
+		concats:    map[string]*smppConcat{},
+		closed:     make(chan struct{}),
+	}
+	if g.addr == "" {
+		return nil, errors.New("SMPP_ADDR is required by the smpp gateway")
+	}
+	if str := os.Getenv("SMPP_ENQUIRE_SECONDS"); str != "" {
+		seconds, err := strconv.Atoi(str)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("Invalid SMPP_ENQUIRE_SECONDS " + str)
+		}
+		g.enquire = time.Duration(seconds) * time.Second
+	}
+	switch str := os.Getenv("SMPP_RECEIPT_IDS"); str {
+	case "", "hex":
+	case "decimal":
+		g.decimalReceiptIDs = true
+	default:
+		return nil, errors.New("Invalid SMPP_RECEIPT_IDS " + str)
+	}
+
+	go g.run()
+	return g, nil
+}
+
+func (g *smppGateway) Name() string {
+	return "smpp"
+}
+
+// Send submit every part of a message and wait for the SMSC to accept it.
+// The result carries the ID of the first part and the IDs of the other parts.
+// When a later part fails, the result of the parts sent is returned with an error that is
+// not retryable, so that no part is sent twice.
+func (g *smppGateway) Send(toNumber string, body string) (*SendResult, error) {
+	g.mu.Lock()
+	g.ref++
+	ref := g.ref
+	g.mu.Unlock()
+
+	dataCoding, parts := smppParts(body, ref)
+	sourceTON, sourceNPI, source := smppAddress(g.sourceAddr)
+	destTON, destNPI, dest := smppAddress(toNumber)
+
+	result := &SendResult{Status: "sent"}
+	for i, part := range parts {
+		sm := &smppShortMessage{
+			SourceTON:          sourceTON,
+			SourceNPI:          sourceNPI,
+			Source:             source,
+			DestTON:            destTON,
+			DestNPI:            destNPI,
+			Destination:        dest,
+			RegisteredDelivery: 1,
+			DataCoding:         dataCoding,
+			Message:            part,
+		}
+		if len(parts) > 1 {
+			sm.EsmClass = smppEsmClassUDHI
+		}
+
+		resp, err := g.request(smppSubmitSm, sm.encode())
+		if err == nil && resp.Status != smppStatusOK {
+			err = &gatewayError{
+				msg:       fmt.Sprintf("SMPP submit_sm failed with status 0x%02X", resp.Status),
+				retryable: smppRetryableStatuses[resp.Status],
+			}
+		}
+		if err != nil && i == 0 {
+			return nil, err
+		}
+		if err != nil {
+			return result, &gatewayError{msg: err.Error(), retryable: false}
+		}
+		id := smppMessageID((&smppReader{b: resp.Body}).cString())
+		if i == 0 {
+			result.MessageID = id
+		} else {
+			result.PartIDs = append(result.PartIDs, id)
+		}
+	}
+
+	return result, nil
+}
+
+// Close stop binding and close the current connection
+func (g *smppGateway) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.closed:
+		return
+	default:
+	}
+	close(g.closed)
+	if g.dialed != nil {
+		g.dialed.Close()
+	}
+}
+
+// request send a command over the bind and wait for its response
+func (g *smppGateway) request(commandID uint32, body []byte) (*smppPDU, error) {
+	g.mu.Lock()
+	conn := g.conn
+	if conn == nil {
+		g.mu.Unlock()
+		return nil, &gatewayError{msg: "SMPP not bound to " + g.addr, retryable: true}
+	}
+	sequence := g.nextSequence()
+	ch := make(chan *smppPDU, 1)
+	g.pending[sequence] = ch
+	g.mu.Unlock()
+
+	if err := g.write(conn, &smppPDU{CommandID: commandID, Sequence: sequence, Body: body}); err != nil {
+		g.forget(sequence)
+		conn.Close()
+		return nil, &gatewayError{msg: err.Error(), retryable: true}
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, &gatewayError{msg: "SMPP bind lost before a response", retryable: true}
+		}
+		return resp, nil
+	case <-time.After(smppTimeout):
+		g.forget(sequence)
+		return nil, &gatewayError{msg: "SMPP response timed out", retryable: true}
+	}
+}
+
+// nextSequence must be called with g.mu held
+func (g *smppGateway) nextSequence() uint32 {
+	g.sequence++
+	if g.sequence > 0x7FFFFFFF {
+		g.sequence = 1
+	}
+	return g.sequence
+}
+
+func (g *smppGateway) forget(sequence uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.pending, sequence)
+}
+
+func (g *smppGateway) write(conn net.Conn, p *smppPDU) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(smppTimeout))
+	_, err := conn.Write(p.bytes())
+	return err
+}
+
+// run keep a bind up until closed, waiting longer after each failure up to a minute
+func (g *smppGateway) run() {
+	wait := time.Second
+	for {
+		bound, err := g.session()
+		select {
+		case <-g.closed:
+			log.Println("SMPP bind to", g.addr, "closed")
+			return
+		default:
+		}
+		log.Println("SMPP bind to", g.addr, "lost:", err.Error())
+		if bound {
+			wait = time.Second
+		}
+		select {
+		case <-g.closed:
+			return
+		case <-time.After(wait):
+		}
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
+}
+
+// session bind as a transceiver then handle PDUs until the connection fails.
+// bound tells whether the bind had succeeded.
+func (g *smppGateway) session() (bound bool, err error) {
+	conn, err := net.DialTimeout("tcp", g.addr, smppTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	g.mu.Lock()
+	select {
+	case <-g.closed:
+		g.mu.Unlock()
+		return false, errors.New("SMPP gateway closed")
+	default:
+	}
+	g.dialed = conn
+	g.mu.Unlock()
+
+	if err := g.bind(conn); err != nil {
+		return false, err
+	}
+	log.Println("SMPP bound to", g.addr, "as", g.systemID)
+
+	g.mu.Lock()
+	g.conn = conn
+	g.mu.Unlock()
+	defer g.unbound()
+
+	done := make(chan struct{})
+	defer close(done)
+	go g.enquireLinks(conn, done)
+
+	for {
+		// enquire_link responses at least arrive in time on a live bind
+		conn.SetReadDeadline(time.Now().Add(3 * g.enquire))
+		p, err := readSmppPDU(conn)
+		if err != nil {
+			return true, err
+		}
+		if err := g.handle(conn, p); err != nil {
+			return true, err
+		}
+	}
+}
+
+// bind send bind_transceiver and wait for the SMSC to accept it
+func (g *smppGateway) bind(conn net.Conn) error {
+	body := []byte(g.systemID + "\x00" + g.password + "\x00" + g.systemType + "\x00")
+	body = append(body, 0x34, 0, 0, 0) // interface_version, addr_ton, addr_npi, address_range
+
+	g.mu.Lock()
+	sequence := g.nextSequence()
+	g.mu.Unlock()
+	if err := g.write(conn, &smppPDU{CommandID: smppBindTransceiver, Sequence: sequence, Body: body}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(smppTimeout))
+	resp, err := readSmppPDU(conn)
+	if err != nil {
+		return err
+	}
+	if resp.CommandID != smppBindTransceiverResp || resp.Sequence != sequence {
+		return fmt.Errorf("Unexpected SMPP command 0x%08X in answer to bind_transceiver", resp.CommandID)
+	}
+	if resp.Status != smppStatusOK {
+		return fmt.Errorf("SMPP bind_transceiver failed with status 0x%02X", resp.Status)
+	}
+	return nil
+}
+
+// unbound fail every request still waiting for a response
+func (g *smppGateway) unbound() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.conn = nil
+	for sequence, ch := range g.pending {
+		close(ch)
+		delete(g.pending, sequence)
+	}
+}
+
+// enquireLinks keep the bind alive until done is closed
+func (g *smppGateway) enquireLinks(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(g.enquire)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			g.mu.Lock()
+			sequence := g.nextSequence()
+			g.mu.Unlock()
+			if err := g.write(conn, &smppPDU{CommandID: smppEnquireLink, Sequence: sequence}); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// handle a PDU received over the bind, an error ends the session
+func (g *smppGateway) handle(conn net.Conn, p *smppPDU) error {
+	switch p.CommandID {
+	case smppEnquireLink:
+		return g.write(conn, &smppPDU{CommandID: smppEnquireLinkResp, Sequence: p.Sequence})
+	case smppDeliverSm:
+		// replies are sent over this same bind, so they cannot be handled by the read loop
+		go g.deliver(conn, p)
+		return nil
+	case smppUnbind:
+		g.write(conn, &smppPDU{CommandID: smppUnbindResp, Sequence: p.Sequence})
+		return errors.New("SMSC unbound")
+	}
+
+	// responses have the high bit set, as generic_nack does
+	if p.CommandID&smppGenericNack != 0 {
+		g.mu.Lock()
+		ch, ok := g.pending[p.Sequence]
+		delete(g.pending, p.Sequence)
+		g.mu.Unlock()
+		if ok {
+			ch <- p
+		}
+		return nil
+	}
+
+	return g.write(conn, &smppPDU{CommandID: smppGenericNack, Status: smppStatusInvalidCmd, Sequence: p.Sequence})
+}
+
+// deliver receive a deliver_sm, acknowledge it then handle the reply it completed if any.
+// A failure to receive it is answered with a temporary error so that the SMSC delivers it again,
+// while a reply is handled only once recorded and acknowledged so that it is not applied twice.
+func (g *smppGateway) deliver(conn net.Conn, p *smppPDU) {
+	status := uint32(smppStatusOK)
+	s, m, err := g.receive(p)
+	if err != nil {
+		log.Println("Failed to receive SMPP deliver_sm:", err.Error())
+		status = smppStatusTempAppErr
+	}
+
+	// message_id is unused and left empty
+	if err := g.write(conn, &smppPDU{CommandID: smppDeliverSmResp, Status: status, Sequence: p.Sequence, Body: []byte{0}}); err != nil {
+		log.Println("Failed to acknowledge SMPP deliver_sm:", err.Error())
+	}
+
+	if m == nil {
+		return
+	}
+	if err := handleInboundSms(*s, m); err == errNoOrderFound {
+		log.Println("Ignored SMPP message from", s.From+":", err.Error())
+	} else if err != nil {
+		log.Println("Failed to handle SMPP message", m.ID, "from", s.From+":", err.Error())
+	}
+}
+
+// receive apply a delivery receipt, or record a reply from a customer once all its parts arrived.
+// The reply and its record m are returned unless it was already received, to be handled.
+func (g *smppGateway) receive(p *smppPDU) (*sms, *message, error) {
+	sm, err := parseSmppShortMessage(p.Body)
+	if err != nil {
+		// delivering it again would not help
+		log.Println("Ignored malformed SMPP deliver_sm:", err.Error())
+		return nil, nil, nil
+	}
+
+	if sm.EsmClass&smppEsmClassReceipt != 0 {
+		id, stat, errCode := parseSmppReceipt(sm, g.decimalReceiptIDs)
+		status, ok := smppReceiptStatuses[stat]
+		if id == "" || !ok {
+			log.Println("Ignored SMPP delivery receipt", id, "with state", stat)
+			return nil, nil, nil
+		}
+		errStr := ""
+		if errCode != "" && errCode != "000" && errCode != "0" {
+			errStr = "SMPP error " + errCode
+		}
+		return nil, nil, updateMessageStatus(id, status, errStr)
+	}
+
+	text, complete := g.reassemble(sm)
+	if !complete || text == "" {
+		return nil, nil, nil
+	}
+	s := &sms{From: smppNumber(sm.SourceTON, sm.Source), To: smppNumber(sm.DestTON, sm.Destination), Body: text, Gateway: g.Name()}
+	// deliver_sm has no message ID, a redelivery is told apart by its content
+	sum := sha1.Sum([]byte(s.From + "\x00" + s.To + "\x00" + s.Body))
+	s.GatewaySID = hex.EncodeToString(sum[:])
+
+	m, recorded, err := recordInboundMessage(s)
+	if err != nil || !recorded {
+		return nil, nil, err
+	}
+	return s, m, nil
+}
+
+// reassemble return the text of a message, complete once every part of it arrived.
+// Parts of messages that never complete are dropped after 10 minutes.
+func (g *smppGateway) reassemble(sm *smppShortMessage) (string, bool) {
+	if sm.EsmClass&smppEsmClassUDHI == 0 {
+		return decodeSmppText(sm.Message, sm.DataCoding), true
+	}
+	ref, total, seq, rest, err := parseConcatUDH(sm.Message)
+	if err != nil {
+		return decodeSmppText(sm.Message, sm.DataCoding), true
+	}
+	if total <= 1 || seq < 1 || seq > total {
+		return decodeSmppText(rest, sm.DataCoding), true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, c := range g.concats {
+		if time.Since(c.startedAt) > 10*time.Minute {
+			delete(g.concats, key)
+		}
+	}
+
+	key := sm.Source + "/" + strconv.Itoa(ref) + "/" + strconv.Itoa(total)
+	c := g.concats[key]
+	if c == nil {
+		c = &smppConcat{parts: make([][]byte, total), startedAt: time.Now()}
+		g.concats[key] = c
+	}
+	c.parts[seq-1] = rest
+
+	joined := []byte{}
+	for _, part := range c.parts {
+		if part == nil {
+			return "", false
+		}
+		joined = append(joined, part...)
+	}
+	delete(g.concats, key)
+	return decodeSmppText(joined, sm.DataCoding), true
+}
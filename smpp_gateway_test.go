@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smppSimulator is a minimal SMSC accepting one transceiver bind.
+// submit_sm are answered with status(n) for the nth one, and hexadecimal message IDs.
+type smppSimulator struct {
+	listener net.Listener
+	status   func(n int) uint32
+
+	mu        sync.Mutex
+	bind      *smppPDU
+	submitted []*smppShortMessage
+}
+
+func newSmppSimulator(t *testing.T, status func(n int) uint32) *smppSimulator {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smppSimulator{listener: listener, status: status}
+	go s.serve()
+	return s
+}
+
+func (s *smppSimulator) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		p, err := readSmppPDU(conn)
+		if err != nil {
+			return
+		}
+
+		resp := &smppPDU{CommandID: p.CommandID | smppGenericNack, Sequence: p.Sequence}
+		switch p.CommandID {
+		case smppBindTransceiver:
+			s.mu.Lock()
+			s.bind = p
+			s.mu.Unlock()
+			resp.Body = []byte("SIM\x00")
+		case smppSubmitSm:
+			sm, err := parseSmppShortMessage(p.Body)
+			if err != nil {
+				resp.Status = smppStatusSysErr
+				break
+			}
+			s.mu.Lock()
+			s.submitted = append(s.submitted, sm)
+			n := len(s.submitted)
+			s.mu.Unlock()
+			resp.Status = s.status(n)
+			resp.Body = []byte(fmt.Sprintf("%08X\x00", 0x19+n))
+		}
+		conn.Write(resp.bytes())
+	}
+}
+
+// boundSmppGateway bind a gateway to the simulator, the way SMPP_* variables configure it
+func boundSmppGateway(t *testing.T, sim *smppSimulator) *smppGateway {
+	os.Setenv("SMPP_ADDR", sim.listener.Addr().String())
+	os.Setenv("SMPP_SYSTEM_ID", "dosms")
+	os.Setenv("SMPP_PASSWORD", "secret")
+	os.Setenv("SMPP_SOURCE_ADDR", "DODO")
+	defer func() {
+		for _, key := range []string{"SMPP_ADDR", "SMPP_SYSTEM_ID", "SMPP_PASSWORD", "SMPP_SOURCE_ADDR"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	g, err := newSmppGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		g.mu.Lock()
+		bound := g.conn != nil
+		g.mu.Unlock()
+		if bound {
+			return g
+		}
+	}
+	t.Fatal("smpp gateway did not bind to the simulator")
+	return nil
+}
+
+func TestSmppGatewaySend(t *testing.T) {
+	sim := newSmppSimulator(t, func(int) uint32 { return smppStatusOK })
+	defer sim.listener.Close()
+	g := boundSmppGateway(t, sim)
+
+	sim.mu.Lock()
+	bindBody := string(sim.bind.Body)
+	sim.mu.Unlock()
+	if !strings.HasPrefix(bindBody, "dosms\x00secret\x00\x00\x34") {
+		t.Errorf("bind_transceiver body = %q", bindBody)
+	}
+
+	body := strings.Repeat("Reply 1, 2 or 3 {HELP} ", 10)
+	result, err := g.Send("+6591234567", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MessageID != "1A" || !reflect.DeepEqual(result.PartIDs, []string{"1B"}) {
+		t.Errorf("Send() = %s with parts %v, want 1A with parts [1B]", result.MessageID, result.PartIDs)
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if len(sim.submitted) != 2 {
+		t.Fatalf("submitted %d parts, want 2", len(sim.submitted))
+	}
+	joined := []byte{}
+	for i, sm := range sim.submitted {
+		if sm.Source != "DODO" || sm.SourceTON != 5 || sm.Destination != "6591234567" || sm.DestTON != 1 || sm.DestNPI != 1 {
+			t.Errorf("part %d addressed from %d/%q to %d/%d/%q", i+1, sm.SourceTON, sm.Source, sm.DestTON, sm.DestNPI, sm.Destination)
+		}
+		if sm.EsmClass != smppEsmClassUDHI || sm.RegisteredDelivery != 1 || sm.DataCoding != smppDataCodingDefault {
+			t.Errorf("part %d esm_class %d, registered_delivery %d, data_coding %d", i+1, sm.EsmClass, sm.RegisteredDelivery, sm.DataCoding)
+		}
+		_, total, seq, rest, err := parseConcatUDH(sm.Message)
+		if err != nil || total != 2 || seq != i+1 {
+			t.Errorf("part %d is %d of %d, %v", i+1, seq, total, err)
+		}
+		joined = append(joined, rest...)
+	}
+	if got := decodeSmppText(joined, smppDataCodingDefault); got != body {
+		t.Errorf("SMSC received %q, want %q", got, body)
+	}
+}
+
+func TestSmppGatewaySendFailures(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        func(n int) uint32
+		wantRetryable bool
+		wantID        string
+	}{
+		{"throttled first part", func(int) uint32 { return smppStatusThrottled }, true, ""},
+		{"rejected first part", func(int) uint32 { return smppStatusInvalidCmd }, false, ""},
+		{"throttled second part", func(n int) uint32 {
+			if n == 2 {
+				return smppStatusThrottled
+			}
+			return smppStatusOK
+		}, false, "1A"},
+	}
+
+	for _, tt := range tests {
+		sim := newSmppSimulator(t, tt.status)
+		g := boundSmppGateway(t, sim)
+
+		result, err := g.Send("+6591234567", strings.Repeat("a", 200))
+		if err == nil {
+			t.Errorf("%s: Send() succeeded", tt.name)
+		} else if isRetryable(err) != tt.wantRetryable {
+			t.Errorf("%s: Send() error %q retryable = %v, want %v", tt.name, err.Error(), isRetryable(err), tt.wantRetryable)
+		}
+		if tt.wantID == "" && result != nil {
+			t.Errorf("%s: Send() = %+v, want no result", tt.name, result)
+		} else if tt.wantID != "" && (result == nil || result.MessageID != tt.wantID || len(result.PartIDs) != 0) {
+			t.Errorf("%s: Send() = %+v, want the ID %s of the part sent", tt.name, result, tt.wantID)
+		}
+		sim.listener.Close()
+	}
+}
+
+func TestSmppGatewayReassemble(t *testing.T) {
+	g := &smppGateway{concats: map[string]*smppConcat{}}
+	parted := func(source, body string, ref byte) []*smppShortMessage {
+		dataCoding, parts := smppParts(body, ref)
+		sms := []*smppShortMessage{}
+		for _, part := range parts {
+			sms = append(sms, &smppShortMessage{Source: source, EsmClass: smppEsmClassUDHI, DataCoding: dataCoding, Message: part})
+		}
+		return sms
+	}
+
+	single := &smppShortMessage{Source: "6591234567", Message: []byte{0x31, 0x2C, 0x32}}
+	if text, complete := g.reassemble(single); !complete || text != "1,2" {
+		t.Errorf("reassemble() single = %q, %v", text, complete)
+	}
+
+	long := strings.Repeat("1 and 2 please ", 12)
+	other := strings.Repeat("ж", 100)
+	a := parted("6591234567", long, 7)
+	b := parted("6598765432", long+"!", 7)
+	c := parted("6591234567", other, 8)
+
+	// parts arrive out of order and interleaved with other messages
+	for _, sm := range []*smppShortMessage{a[1], b[0], c[1], b[1]} {
+		text, complete := g.reassemble(sm)
+		if complete && sm != b[1] {
+			t.Errorf("reassemble() completed %q early", text)
+		}
+		if sm == b[1] && (!complete || text != long+"!") {
+			t.Errorf("reassemble() second sender = %q, %v", text, complete)
+		}
+	}
+	if text, complete := g.reassemble(a[0]); !complete || text != long {
+		t.Errorf("reassemble() = %q, %v, want %q", text, complete, long)
+	}
+	if text, complete := g.reassemble(c[0]); !complete || text != other {
+		t.Errorf("reassemble() ucs2 = %q, %v, want %q", text, complete, other)
+	}
+	if len(g.concats) != 0 {
+		t.Errorf("%d incomplete messages left after reassembly", len(g.concats))
+	}
+
+	// a part whose message never completed is dropped after 10 minutes
+	d := parted("6591234567", long, 9)
+	g.reassemble(d[0])
+	for _, c := range g.concats {
+		c.startedAt = time.Now().Add(-11 * time.Minute)
+	}
+	if _, complete := g.reassemble(d[1]); complete {
+		t.Error("reassemble() completed a message with a stale part")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSmppPDURoundTrip(t *testing.T) {
+	pdus := []*smppPDU{
+		{CommandID: smppEnquireLink, Sequence: 1, Body: []byte{}},
+		{CommandID: smppSubmitSmResp, Status: smppStatusThrottled, Sequence: 0x7FFFFFFF, Body: []byte("1A\x00")},
+	}
+
+	stream := &bytes.Buffer{}
+	for _, p := range pdus {
+		stream.Write(p.bytes())
+	}
+	for _, want := range pdus {
+		got, err := readSmppPDU(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readSmppPDU() = %+v, want %+v", got, want)
+		}
+	}
+
+	if _, err := readSmppPDU(bytes.NewReader([]byte{0, 0, 0, 8, 0, 0, 0, 0x15, 0, 0, 0, 0, 0, 0, 0, 1})); err == nil {
+		t.Error("readSmppPDU() accepted a length shorter than the header")
+	}
+	truncated := (&smppPDU{CommandID: smppSubmitSmResp, Body: []byte("1A\x00")}).bytes()
+	if _, err := readSmppPDU(bytes.NewReader(truncated[:len(truncated)-1])); err == nil {
+		t.Error("readSmppPDU() accepted a truncated body")
+	}
+}
+
+func TestSmppShortMessageRoundTrip(t *testing.T) {
+	want := &smppShortMessage{
+		SourceTON:          5,
+		SourceNPI:          0,
+		Source:             "DODO",
+		DestTON:            1,
+		DestNPI:            1,
+		Destination:        "6591234567",
+		EsmClass:           smppEsmClassUDHI,
+		RegisteredDelivery: 1,
+		DataCoding:         smppDataCodingUCS2,
+		Message:            []byte{0x05, 0x00, 0x03, 0x2A, 0x02, 0x01, 0x04, 0x36},
+		TLVs:               map[uint16][]byte{},
+	}
+
+	got, err := parseSmppShortMessage(want.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSmppShortMessage(encode()) = %+v, want %+v", got, want)
+	}
+
+	withTLVs := append(want.encode(), 0x04, 0x27, 0x00, 0x01, 0x02, 0x00, 0x1E, 0x00, 0x03, '1', 'A', 0)
+	got, err = parseSmppShortMessage(withTLVs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTLVs := map[uint16][]byte{smppTagMessageState: {2}, smppTagReceiptedMessageID: []byte("1A\x00")}
+	if !reflect.DeepEqual(got.TLVs, wantTLVs) {
+		t.Errorf("parseSmppShortMessage() TLVs = %v, want %v", got.TLVs, wantTLVs)
+	}
+
+	encoded := want.encode()
+	if _, err := parseSmppShortMessage(encoded[:len(encoded)-1]); err == nil {
+		t.Error("parseSmppShortMessage() accepted a truncated short message")
+	}
+	if _, err := parseSmppShortMessage([]byte("no terminator")); err == nil {
+		t.Error("parseSmppShortMessage() accepted an unterminated string")
+	}
+}
+
+func TestGsm7RoundTrip(t *testing.T) {
+	text := gsm7Basic + gsm7Extension
+	encoded := []byte{}
+	for _, r := range text {
+		encoded = append(encoded, gsm7Encode(r)...)
+	}
+	if len(encoded) != encodeSms(text).Units {
+		t.Errorf("gsm7Encode() took %d septets, encodeSms counts %d", len(encoded), encodeSms(text).Units)
+	}
+	if got := gsm7Decode(encoded); got != text {
+		t.Errorf("gsm7Decode(gsm7Encode()) = %q, want %q", got, text)
+	}
+}
+
+func TestGsm7Decode(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"basic", []byte{0x48, 0x69, 0x00, 0x01}, "Hi@£"},
+		{"extension", []byte{0x1B, 0x65, 0x35}, "€5"},
+		{"trailing escape dropped", []byte{0x48, 0x69, 0x1B}, "Hi"},
+		{"escape of no extension reads the code", []byte{0x1B, 0x41, 0x42}, "AB"},
+		{"double escape dropped", []byte{0x41, 0x1B, 0x1B, 0x42}, "AB"},
+		{"high bit ignored", []byte{0xC1, 0x9B, 0xE5}, "A€"},
+		{"empty", []byte{}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := gsm7Decode(tt.b); got != tt.want {
+			t.Errorf("%s: gsm7Decode(% X) = %q, want %q", tt.name, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSmppParts(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		dataCoding byte
+		lengths    []int
+	}{
+		{"gsm7 single", strings.Repeat("a", 160), smppDataCodingDefault, []int{160}},
+		{"gsm7 extension single", strings.Repeat("€", 80), smppDataCodingDefault, []int{160}},
+		{"gsm7 two parts", strings.Repeat("a", 161), smppDataCodingDefault, []int{6 + 153, 6 + 8}},
+		{"gsm7 escape not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), smppDataCodingDefault, []int{6 + 152, 6 + 153, 6 + 1}},
+		{"ucs2 single", strings.Repeat("ж", 70), smppDataCodingUCS2, []int{140}},
+		{"ucs2 two parts", strings.Repeat("ж", 71), smppDataCodingUCS2, []int{6 + 134, 6 + 8}},
+		{"ucs2 surrogate pair not split", strings.Repeat("ж", 66) + "😀" + strings.Repeat("ж", 66), smppDataCodingUCS2, []int{6 + 132, 6 + 134, 6 + 2}},
+	}
+
+	for _, tt := range tests {
+		dataCoding, parts := smppParts(tt.body, 42)
+		if dataCoding != tt.dataCoding {
+			t.Errorf("%s: data coding = %d, want %d", tt.name, dataCoding, tt.dataCoding)
+		}
+		lengths := []int{}
+		for _, part := range parts {
+			lengths = append(lengths, len(part))
+		}
+		if !reflect.DeepEqual(lengths, tt.lengths) {
+			t.Errorf("%s: part lengths = %v, want %v", tt.name, lengths, tt.lengths)
+		}
+		if len(parts) != encodeSms(tt.body).Segments {
+			t.Errorf("%s: %d parts, encodeSms counts %d segments", tt.name, len(parts), encodeSms(tt.body).Segments)
+		}
+
+		if len(parts) == 1 {
+			if got := decodeSmppText(parts[0], dataCoding); got != tt.body {
+				t.Errorf("%s: decoded %q, want %q", tt.name, got, tt.body)
+			}
+			continue
+		}
+		joined := []byte{}
+		for i, part := range parts {
+			ref, total, seq, rest, err := parseConcatUDH(part)
+			if err != nil || ref != 42 || total != len(parts) || seq != i+1 {
+				t.Errorf("%s: part %d header = ref %d, %d of %d, %v", tt.name, i+1, ref, seq, total, err)
+			}
+			joined = append(joined, rest...)
+		}
+		if got := decodeSmppText(joined, dataCoding); got != tt.body {
+			t.Errorf("%s: reassembled %q, want %q", tt.name, got, tt.body)
+		}
+	}
+}
+
+func TestParseConcatUDH(t *testing.T) {
+	ref, total, seq, rest, err := parseConcatUDH([]byte{0x06, 0x08, 0x04, 0x01, 0x02, 0x03, 0x02, 0x41})
+	if err != nil || ref != 0x0102 || total != 3 || seq != 2 || string(rest) != "A" {
+		t.Errorf("parseConcatUDH() 16 bit = ref %d, %d of %d, %q, %v", ref, seq, total, rest, err)
+	}
+
+	// other information elements are skipped
+	ref, total, seq, rest, err = parseConcatUDH([]byte{0x08, 0x24, 0x01, 0x00, 0x00, 0x03, 0x07, 0x02, 0x01, 0x41})
+	if err != nil || ref != 7 || total != 2 || seq != 1 || string(rest) != "A" {
+		t.Errorf("parseConcatUDH() after another element = ref %d, %d of %d, %q, %v", ref, seq, total, rest, err)
+	}
+
+	if _, total, _, _, err := parseConcatUDH([]byte{0x02, 0x24, 0x01, 0x41}); err != nil || total != 0 {
+		t.Errorf("parseConcatUDH() without concatenation = total %d, %v", total, err)
+	}
+	if _, _, _, _, err := parseConcatUDH([]byte{0x05, 0x00, 0x03}); err == nil {
+		t.Error("parseConcatUDH() accepted a truncated header")
+	}
+}
+
+func TestDecodeSmppText(t *testing.T) {
+	tests := []struct {
+		b          []byte
+		dataCoding byte
+		want       string
+	}{
+		{[]byte{0x04, 0x36, 0xD8, 0x3D, 0xDE, 0x00}, smppDataCodingUCS2, "ж😀"},
+		{[]byte{0x43, 0xE9}, smppDataCodingLatin1, "Cé"},
+		{[]byte("a{b}"), smppDataCodingIA5, "a{b}"},
+		{[]byte{0x1B, 0x28, 0x31, 0x1B, 0x29}, smppDataCodingDefault, "{1}"},
+	}
+
+	for _, tt := range tests {
+		if got := decodeSmppText(tt.b, tt.dataCoding); got != tt.want {
+			t.Errorf("decodeSmppText(% X, %d) = %q, want %q", tt.b, tt.dataCoding, got, tt.want)
+		}
+	}
+}
+
+func TestParseSmppReceipt(t *testing.T) {
+	text := "id:0000000026 sub:001 dlvrd:001 submit date:1801151200 done date:1801151201 stat:DELIVRD err:000 text:Hi"
+	tests := []struct {
+		name    string
+		sm      *smppShortMessage
+		id      string
+		stat    string
+		errCode string
+	}{
+		{"text", &smppShortMessage{Message: []byte(text)}, "26", "DELIVRD", "000"},
+		{"lower case hex", &smppShortMessage{Message: []byte("id:00ab1f stat:UNDELIV err:001")}, "AB1F", "UNDELIV", "001"},
+		{"tlvs override text", &smppShortMessage{
+			Message: []byte(text),
+			TLVs:    map[uint16][]byte{smppTagReceiptedMessageID: []byte("1a\x00"), smppTagMessageState: {5}},
+		}, "1A", "UNDELIV", "000"},
+		{"nothing", &smppShortMessage{Message: []byte("hello")}, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		id, stat, errCode := parseSmppReceipt(tt.sm, false)
+		if id != tt.id || stat != tt.stat || errCode != tt.errCode {
+			t.Errorf("%s: parseSmppReceipt() = %q %q %q, want %q %q %q", tt.name, id, stat, errCode, tt.id, tt.stat, tt.errCode)
+		}
+	}
+}
+
+func TestParseSmppReceiptDecimalIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		sm   *smppShortMessage
+		id   string
+	}{
+		{"decimal text", &smppShortMessage{Message: []byte("id:0000000026 stat:DELIVRD err:000")}, "1A"},
+		{"not a number", &smppShortMessage{Message: []byte("id:msg-1 stat:DELIVRD err:000")}, "MSG-1"},
+		{"tlv kept as is", &smppShortMessage{
+			Message: []byte("id:0000000026 stat:DELIVRD err:000"),
+			TLVs:    map[uint16][]byte{smppTagReceiptedMessageID: []byte("26\x00")},
+		}, "26"},
+	}
+
+	for _, tt := range tests {
+		if id, _, _ := parseSmppReceipt(tt.sm, true); id != tt.id {
+			t.Errorf("%s: parseSmppReceipt() id = %q, want %q", tt.name, id, tt.id)
+		}
+	}
+}
+
+func TestSmppMessageID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"0000001A", "1A"},
+		{"1a", "1A"},
+		{"12345", "12345"},
+		{"0", "0"},
+		{"000", "0"},
+		{"msg-1", "MSG-1"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := smppMessageID(tt.id); got != tt.want {
+			t.Errorf("smppMessageID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSmppAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		ton, npi byte
+		digits   string
+		number   string
+	}{
+		{"+6591234567", 1, 1, "6591234567", "+6591234567"},
+		{"91234567", 0, 1, "91234567", "91234567"},
+		{"DODO", 5, 0, "DODO", "DODO"},
+	}
+
+	for _, tt := range tests {
+		ton, npi, digits := smppAddress(tt.addr)
+		if ton != tt.ton || npi != tt.npi || digits != tt.digits {
+			t.Errorf("smppAddress(%q) = %d %d %q, want %d %d %q", tt.addr, ton, npi, digits, tt.ton, tt.npi, tt.digits)
+		}
+		if number := smppNumber(ton, digits); number != tt.number {
+			t.Errorf("smppNumber(%d, %q) = %q, want %q", ton, digits, number, tt.number)
+		}
+	}
+}
@@ -1,224 +1,298 @@
 package main
 
 import (
-	"io/ioutil"
+	"errors"
+	"log"
 	"net/http"
-	"net/url"
-	"os"
-	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// sms is a message to send or received from a customer.
+// Received ones carry the Gateway they came through and its ID for them, if any.
 type sms struct {
-	From string `json:"from,omitempty" schema:"From"`
-	To   string `json:"to" schema:"To"`
-	Body string `json:"body" schema:"Body"`
+	From       string `json:"from,omitempty" schema:"From"`
+	To         string `json:"to" schema:"To"`
+	Body       string `json:"body" schema:"Body"`
+	Gateway    string `json:"-" schema:"-"`
+	GatewaySID string `json:"-" schema:"MessageSid"`
 }
 
-func sendWithTwilio(toNumber string, body string) (*http.Response, error) {
-	urlStr := "https://api.twilio.com/2010-04-01/Accounts/" + os.Getenv("TWILIO_SID") + "/Messages.json"
-	msgData := url.Values{}
-	msgData.Set("From", os.Getenv("TWILIO_NUMBER"))
-	msgData.Set("To", toNumber)
-	msgData.Set("Body", body)
-	msgDataReader := *strings.NewReader(msgData.Encode())
+type smsStatus struct {
+	MessageSID    string `schema:"MessageSid"`
+	MessageStatus string `schema:"MessageStatus"`
+	ErrorCode     string `schema:"ErrorCode"`
+}
 
-	req, err := http.NewRequest("POST", urlStr, &msgDataReader)
-	if err != nil {
-		return nil, err
+// sendSms send a message through whichever gateway is configured
+// and record it in the message log against orderID (0 for none)
+func sendSms(orderID int64, toNumber string, body string) (*SendResult, error) {
+	return sendMessage(&message{OrderID: orderID, ContactNumber: toNumber, Body: body})
+}
+
+// sendSlotMenuSms send a message listing o.Provider.Slots
+func sendSlotMenuSms(o *order, body string) (*SendResult, error) {
+	return sendMessage(slotMenuMessage(o, body))
+}
+
+// slotMenuMessage keep the numbering of o.Provider.Slots the customer saw
+// with the message, so that replies are resolved against it
+func slotMenuMessage(o *order, body string) *message {
+	m := &message{OrderID: o.ID, ContactNumber: o.ContactNumber, Body: body, SlotMenu: []int64{}, Reply: o.replying}
+	for _, s := range o.Provider.Slots {
+		m.SlotMenu = append(m.SlotMenu, s.ID)
+	}
+	return m
+}
+
+// sendMessage hand a message to the gateway, unless the customer opted out
+// in which case it is only recorded as suppressed.
+// Replies to the customer are sent regardless, as they asked for them.
+func sendMessage(m *message) (*SendResult, error) {
+	m.Body = prepareSmsBody(m.Body)
+	e := encodeSms(m.Body)
+	m.Encoding = e.Encoding
+	m.Segments = e.Segments
+
+	optedOut := false
+	if !m.Reply {
+		var err error
+		if optedOut, err = isOptedOut(m.ContactNumber, m.OrderID); err != nil {
+			return nil, err
+		}
+	}
+	if optedOut {
+		m.Direction = directionOutbound
+		m.Status = messageStatusSuppressed
+		if err := insertMessage(m); err != nil {
+			return nil, err
+		}
+		return &SendResult{Status: messageStatusSuppressed}, nil
 	}
-	req.SetBasicAuth(os.Getenv("TWILIO_SID"), os.Getenv("TWILIO_TOKEN"))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	return httpsClient.Do(req)
+	m.EstimatedCost, m.CostUnit = estimateSmsCost(m.Segments)
+	result, err := smsGateway.Send(m.ContactNumber, m.Body)
+	recordOutboundMessage(m, result, err)
+
+	return result, err
 }
 
 // sendReminderSms send standard reminder sms the day before delivery
 // order must have Provider populated.
 // order.Provider must have Slots populated.
-func sendReminderSms(o *order) (*http.Response, error) {
-	bodyStr := "From: " + o.Provider.Title + "\n"
-	bodyStr += "Hello " + o.CustomerName + ", your delivery is scheduled to be delivered tomorrow "
-	bodyStr += time.Now().Add(time.Hour*time.Duration(24)).Format("Mon 2006 Jan 02") + ". "
-	bodyStr += "Please state your available time slots by replying the number beside the time slot. If you’re available for more than one time slot, reply with a space between the numbers. E.g 1 2 4\nIgnore this message if it’s not meant for you.\n\n"
-
-	for idx, s := range o.Provider.Slots {
-		bodyStr += strconv.Itoa(idx) + ": " + s.StartTime + ":00" + "-" + s.EndTime + ":00" + "\n"
+// Slot times are wall clock times in the provider timezone.
+// deferredFrom is when the reminder was due if quiet hours held it back, nil otherwise.
+func sendReminderSms(o *order, deferredFrom *time.Time) (*SendResult, error) {
+	bodyStr, err := renderOrderSms(o, templateReminder)
+	if err != nil {
+		return nil, err
 	}
 
-	return sendWithTwilio(o.ContactNumber, bodyStr)
+	m := slotMenuMessage(o, bodyStr)
+	m.DeferredFrom = deferredFrom
+	return sendMessage(m)
 }
 
-// sendConfirmationSms send standard cofirmation sms after receive slot
-// order must have Choices populated.
-// order.Choices must have TimeSlot populated
-func sendConfirmationSms(o *order) (*http.Response, error) {
-	bodyStr := "Thank you " + o.CustomerName + ". The courier will be coming during your available time slots: "
-	for i, c := range o.Choices {
-		bodyStr += c.TimeSlot.StartTime + ":00" + "-" + c.TimeSlot.EndTime + ":00"
-		if i < len(o.Choices)-1 {
-			bodyStr += ", "
+// slotMenu list the slots that still have room, one per line, numbered by
+// their position among all slots so that numbers do not shift as slots fill up
+func slotMenu(slots []*timeSlot) string {
+	menu := ""
+	for idx, s := range slots {
+		if s.isFull() {
+			continue
 		}
+		menu += strconv.Itoa(idx+1) + ": " + s.String() + "\n"
+	}
+	return menu
+}
+
+// sendOrderSms send the message of an order rendered from a template
+// order must have Provider populated
+func sendOrderSms(o *order, templateName string) (*SendResult, error) {
+	bodyStr, err := renderOrderSms(o, templateName)
+	if err != nil {
+		return nil, err
 	}
-	bodyStr += ". Do note that delivery might sometimes be off schedule due to unforeseen circumstances. Reply ‘WRONG’ if you would like to change your available time slots. Otherwise, thank you for your time."
+	return sendMessage(&message{OrderID: o.ID, ContactNumber: o.ContactNumber, Body: bodyStr, Reply: o.replying})
+}
 
-	return sendWithTwilio(o.ContactNumber, bodyStr)
+// sendConfirmationSms send standard cofirmation sms after receive slot
+// order must have Provider and Choices populated.
+// order.Choices must have TimeSlot populated
+func sendConfirmationSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateConfirmation)
 }
 
 // sendRetrySms send standard retry sms
 // order must have Provider populate
 // order.Provider must have Slots populated
-func sendRetrySms(o *order, lastChance bool) (*http.Response, error) {
-	bodyStr := "Please reply the number that represents your available time slot. If you’re available for more than one time slot, reply with a space between the numbers. E.g 1 2 4\n\n"
+func sendRetrySms(o *order, lastChance bool) (*SendResult, error) {
+	templateName := templateRetry
 	if lastChance {
-		bodyStr = "Please confirm your available time slot. There will be no more changes after this. " + bodyStr
+		templateName = templateLastChance
 	}
-	for idx, s := range o.Provider.Slots {
-		bodyStr += strconv.Itoa(idx) + ": " + s.StartTime + ":00" + "-" + s.EndTime + ":00" + "\n"
+	bodyStr, err := renderOrderSms(o, templateName)
+	if err != nil {
+		return nil, err
 	}
 
-	return sendWithTwilio(o.ContactNumber, bodyStr)
+	return sendSlotMenuSms(o, bodyStr)
 }
 
-// sendMaxExceededSms send standard sms after max retries made
-// order must have valid ContactNumber field
-func sendMaxExceededSms(o *order) (*http.Response, error) {
-	bodyStr := "You have exceeded the number of changes. Please call +6581489408 to confirm your delivery timings. Thank you."
-	return sendWithTwilio(o.ContactNumber, bodyStr)
-}
-
-func handleChoosingSlots(w http.ResponseWriter, s *sms) {
-	choicesIdxArr := strings.Split(strings.TrimSpace(s.Body), " ")
-	if len(choicesIdxArr) <= 0 {
-		http.Error(w, "No choices made", 400)
-		return
-	}
-
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE contact_number = $1 AND NOT deleted`, s.From)
+// sendInvalidReplySms explain why a reply could not be understood and resend the slots
+// order must have Provider populated
+// order.Provider must have Slots populated
+func sendInvalidReplySms(o *order, reason string) (*SendResult, error) {
+	data, err := newSmsTemplateData(o)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	} else if len(orders) <= 0 {
-		http.Error(w, "No Order Found", 404)
-		return
-	}
-	o := orders[0]
-	if o.RetriesCount >= 3 {
-		sendMaxExceededSms(o)
-		return
+		return nil, err
 	}
-
-	slots, err := fetchTimeSlots(`
-		SELECT id, EXTRACT(HOUR FROM start_time), EXTRACT(HOUR FROM end_time), provider_id
-		FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC
-	`, o.ProviderID)
+	data.Reason = reason
+	bodyStr, err := renderSms(o.Provider, o.locale(), templateInvalidReply, data)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
 
-	// clear all previously made choices
-	query := `UPDATE choices SET deleted = TRUE WHERE order_id = $1`
-	stmt, err := dbConn.Prepare(query)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	_, err = stmt.Exec(o.ID)
+	return sendSlotMenuSms(o, bodyStr)
+}
+
+// sendSlotsFullSms send the slots still available after only full ones were chosen
+// order must have Provider populated
+// order.Provider must have Slots populated
+func sendSlotsFullSms(o *order) (*SendResult, error) {
+	bodyStr, err := renderOrderSms(o, templateSlotsFull)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
 
-	noChoiceMade := true
-	for i, slot := range slots {
-		for _, idx := range choicesIdxArr {
-			if strconv.Itoa(i) == idx {
-				noChoiceMade = false
-				query := `INSERT INTO choices(time_slot_id, order_id) VALUES($1, $2) RETURNING time_slot_id`
-				var timeSlotID int64
-				err := dbConn.QueryRow(query, slot.ID, o.ID).Scan(&timeSlotID)
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-				o.Choices = append(o.Choices, &choice{TimeSlot: slot})
-			}
+	return sendSlotMenuSms(o, bodyStr)
+}
+
+// sendMaxExceededSms send standard sms after max retries made
+// order must have Provider populated
+func sendMaxExceededSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateMaxExceeded)
+}
+
+// sendWhichOrderSms ask a customer with several deliveries in progress
+// to prefix their reply with the code of the order,
+// using the templates of the provider and locale of the first order
+// orders must have Provider populated
+func sendWhichOrderSms(toNumber string, orders []*order) (*SendResult, error) {
+	ordersData := []*smsTemplateData{}
+	for _, o := range orders {
+		orderData, err := newSmsTemplateData(o)
+		if err != nil {
+			return nil, err
 		}
+		ordersData = append(ordersData, orderData)
 	}
-	if noChoiceMade {
-		http.Error(w, "No choice made", 400)
-		return
-	}
-	query = `UPDATE orders SET retries_count = retries_count + 1 WHERE id = $1`
-	stmt, err = dbConn.Prepare(query)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	_, err = stmt.Exec(o.ID)
+	data := *ordersData[0]
+	data.Orders = ordersData
+	bodyStr, err := renderSms(orders[0].Provider, orders[0].locale(), templateWhichOrder, &data)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
 
-	sendConfirmationSms(o)
+	// only ever sent in answer to the customer
+	return sendMessage(&message{ContactNumber: toNumber, Body: bodyStr, Reply: true})
 }
 
-func handleRetry(w http.ResponseWriter, s *sms) {
-	orders, err := fetchOrders(`SELECT id, customer_name, contact_number, to_char(delivery_date, 'YYYY-MM-DD'), provider_id, retries_count FROM orders WHERE contact_number = $1 AND NOT deleted`, s.From)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	} else if len(orders) <= 0 {
-		http.Error(w, "No Order Found", 404)
-		return
-	}
-	o := orders[0]
-	if o.RetriesCount >= 3 {
-		sendMaxExceededSms(o)
+// sendPastDeliverySms answer a reply about a delivery that is already over
+// order must have Provider populated
+func sendPastDeliverySms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templatePastDelivery)
+}
+
+// sendHelpSms list what the customer can reply and who to call
+// order must have Provider populated
+func sendHelpSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateHelp)
+}
+
+// sendStatusSms tell the customer the delivery date and the slots chosen so far
+// order must have Provider populated
+// order.Choices must have TimeSlot populated
+func sendStatusSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateStatus)
+}
+
+// sendCancelRequestedSms acknowledge a request to cancel the delivery
+// order must have Provider populated
+func sendCancelRequestedSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateCancelRequested)
+}
+
+// sendOptOutSms acknowledge a customer asking not to be texted anymore
+// order must have Provider populated
+func sendOptOutSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateOptOut)
+}
+
+// sendOptInSms acknowledge a customer asking to be texted again
+// order must have Provider populated
+func sendOptInSms(o *order) (*SendResult, error) {
+	return sendOrderSms(o, templateOptIn)
+}
+
+// POST /api/sms
+func sendAnSms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s := sms{}
+	if err := ReadRequestBody(r, &s); err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	slots, err := fetchTimeSlots(`
-		SELECT id, EXTRACT(HOUR FROM start_time), EXTRACT(HOUR FROM end_time), provider_id
-		FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC
-	`, o.ProviderID)
+	result, err := sendSms(0, s.To, s.Body)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), 502)
 		return
 	}
-	o.Provider = new(provider)
-	o.Provider.Slots = slots
 
-	lastChance := o.RetriesCount == 2
+	RenderJSON(w, result)
+}
+
+// GET /api/sms/outbox
+// only available when the fake gateway is configured
+func getFakeOutbox(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	g, ok := findGateway("fake").(*fakeGateway)
+	if !ok {
+		http.Error(w, "Not Found", 404)
+		return
+	}
 
-	sendRetrySms(o, lastChance)
+	RenderJSON(w, map[string][]*fakeSms{"messages": g.sent()})
 }
 
-// POST /api/sms
-func sendAnSms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	s := sms{}
-	if err := ReadRequestBody(r, &s); err != nil {
+// POST /api/sms/status
+// Twilio StatusCallback webhook
+func updateSmsStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	st := smsStatus{}
+	if err := ReadRequestBody(r, &st); err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
+	if st.MessageSID == "" || st.MessageStatus == "" {
+		http.Error(w, "Invalid Status Callback", 400)
+		return
+	}
 
-	resp, _ := sendWithTwilio(s.To, s.Body)
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		b, _ := ioutil.ReadAll(resp.Body)
-		RenderJSON(w, b)
-	} else {
-		b, _ := ioutil.ReadAll(resp.Body)
-		http.Error(w, string(b), resp.StatusCode)
+	errStr := ""
+	if st.ErrorCode != "" {
+		errStr = "Twilio error " + st.ErrorCode
+	}
+	if err := updateMessageStatus(st.MessageSID, st.MessageStatus, errStr); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
+
+	RenderJSON(w, map[string]string{})
 }
 
 // POST /api/sms/reply
+// Twilio inbound message webhook
 func respondToSms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	s := sms{}
 	if err := ReadRequestBody(r, &s); err != nil {
@@ -231,21 +305,56 @@ func respondToSms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	choosingSlots, err := regexp.Match("^[\\s\\d]+$", []byte(s.Body))
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+	s.Gateway = "twilio"
+	if err := receiveSms(s); err == errNoOrderFound {
+		http.Error(w, err.Error(), 404)
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
 	}
-	if choosingSlots {
-		handleChoosingSlots(w, &s)
-		return
+}
+
+var errNoOrderFound = errors.New("No Order Found")
+
+// receiveSms record a reply from a customer then handle it, whichever gateway it came through.
+// s.From must be in the same format as order contact numbers.
+// A reply the gateway already delivered is ignored so that it is not applied twice.
+// Once recorded, failing to handle the reply is only logged, as delivering it again would not help.
+// errNoOrderFound is returned when the number has no order to reply about.
+func receiveSms(s sms) error {
+	m, recorded, err := recordInboundMessage(&s)
+	if err != nil || !recorded {
+		return err
 	}
 
-	retrying := strings.ToUpper(s.Body) == "WRONG"
-	if retrying {
-		handleRetry(w, &s)
-		return
+	err = handleInboundSms(s, m)
+	if err != nil && err != errNoOrderFound {
+		log.Println("Failed to handle sms", m.ID, "from", s.From+":", err.Error())
+		return nil
+	}
+	return err
+}
+
+// handleInboundSms apply a reply from a customer recorded as m
+func handleInboundSms(s sms, m *message) error {
+	o, asked, err := routeReply(&s)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		if asked {
+			return nil
+		}
+		// numbers without orders can still opt out of everything
+		if err := optOutUnknownNumber(&s); err != nil {
+			return err
+		}
+		return errNoOrderFound
+	}
+	if err := setMessageOrder(m.ID, o.ID); err != nil {
+		return err
 	}
 
-	http.Error(w, "Invalid SMS Reply", 400)
+	// anything but a keyword is read as slot numbers, with a correction sent back if invalid
+	o.replying = true
+	return handleReply(o, &s, o.Provider.Keywords.intentOf(s.Body, o.locale()))
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// encodings an sms body can be sent in
+const (
+	encodingGSM7 = "GSM-7"
+	encodingUCS2 = "UCS-2"
+)
+
+// gsm7Basic is the GSM 03.38 default alphabet, one septet per character
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// gsm7Extension characters are sent as an escape and a septet, so take two
+const gsm7Extension = "\f^{}\\[~]|€"
+
+// smartPunctuation is replaced by its GSM-7 look-alike when transliterating
+var smartPunctuation = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201a", "'", "\u2032", "'",
+	"\u201c", "\"", "\u201d", "\"", "\u201e", "\"", "\u2033", "\"",
+	"\u2010", "-", "\u2011", "-", "\u2013", "-", "\u2014", "-",
+	"\u2026", "...", "\u2022", "-",
+	"\u00a0", " ", "\u202f", " ", "\u200b", "",
+)
+
+// smsEncoding is how a body would be sent and split
+type smsEncoding struct {
+	Encoding string `json:"encoding"`
+	Units    int    `json:"units"`
+	Segments int    `json:"segments"`
+}
+
+// gsm7Septets return how many septets a character takes in GSM-7, 0 if it cannot be sent in GSM-7
+func gsm7Septets(r rune) int {
+	if strings.ContainsRune(gsm7Basic, r) {
+		return 1
+	}
+	if strings.ContainsRune(gsm7Extension, r) {
+		return 2
+	}
+	return 0
+}
+
+// encodeSms tell whether body fits GSM-7 or needs UCS-2, and how many segments it is split into.
+// Units are septets for GSM-7 and UTF-16 code units for UCS-2.
+// Concatenated segments lose room to their header, and escape sequences
+// or surrogate pairs are never split across two segments.
+func encodeSms(body string) smsEncoding {
+	units := []int{}
+	gsm7 := true
+	for _, r := range body {
+		septets := gsm7Septets(r)
+		if septets == 0 {
+			gsm7 = false
+			break
+		}
+		units = append(units, septets)
+	}
+
+	single, multi := 160, 153
+	e := smsEncoding{Encoding: encodingGSM7}
+	if !gsm7 {
+		single, multi = 70, 67
+		e.Encoding = encodingUCS2
+		units = units[:0]
+		for _, r := range body {
+			units = append(units, len(utf16.Encode([]rune{r})))
+		}
+	}
+
+	for _, u := range units {
+		e.Units += u
+	}
+	if e.Units <= single {
+		e.Segments = 1
+		return e
+	}
+
+	e.Segments = 1
+	used := 0
+	for _, u := range units {
+		if used+u > multi {
+			e.Segments++
+			used = 0
+		}
+		used += u
+	}
+	return e
+}
+
+// transliterateSms replace smart punctuation with GSM-7 characters
+// so that a body which only needs UCS-2 for them is sent as GSM-7
+func transliterateSms(body string) string {
+	return smartPunctuation.Replace(body)
+}
+
+// prepareSmsBody transliterate body before sending when SMS_TRANSLITERATE is true
+func prepareSmsBody(body string) string {
+	if os.Getenv("SMS_TRANSLITERATE") != "true" {
+		return body
+	}
+	return transliterateSms(body)
+}
+
+// estimateSmsCost is the cost of sending segments, from SMS_SEGMENT_COST per segment
+// in SMS_COST_UNIT (USD by default). It is 0 if no segment cost is configured.
+func estimateSmsCost(segments int) (float64, string) {
+	unit := os.Getenv("SMS_COST_UNIT")
+	if unit == "" {
+		unit = "USD"
+	}
+	segmentCost, err := strconv.ParseFloat(os.Getenv("SMS_SEGMENT_COST"), 64)
+	if err != nil {
+		return 0, unit
+	}
+	return segmentCost * float64(segments), unit
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncodeSms(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want smsEncoding
+	}{
+		{"empty", "", smsEncoding{encodingGSM7, 0, 1}},
+		{"gsm7 single", strings.Repeat("a", 160), smsEncoding{encodingGSM7, 160, 1}},
+		{"gsm7 one over single", strings.Repeat("a", 161), smsEncoding{encodingGSM7, 161, 2}},
+		{"gsm7 two full parts", strings.Repeat("a", 306), smsEncoding{encodingGSM7, 306, 2}},
+		{"gsm7 one over two parts", strings.Repeat("a", 307), smsEncoding{encodingGSM7, 307, 3}},
+		{"gsm7 basic accents", "Ça coute 5£ à Ørsted", smsEncoding{encodingGSM7, 20, 1}},
+		{"accent outside gsm7 needs ucs2", "Ça coûte 5£ à Ørsted", smsEncoding{encodingUCS2, 20, 1}},
+		{"gsm7 extension takes two", strings.Repeat("€", 80), smsEncoding{encodingGSM7, 160, 1}},
+		{"gsm7 extension over single", strings.Repeat("{", 81), smsEncoding{encodingGSM7, 162, 2}},
+		{"gsm7 mixed extension", "[1] ~ 2^3 | {4}", smsEncoding{encodingGSM7, 22, 1}},
+		{"gsm7 escape not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), smsEncoding{encodingGSM7, 306, 3}},
+		{"ucs2 single", strings.Repeat("ж", 70), smsEncoding{encodingUCS2, 70, 1}},
+		{"ucs2 one over single", strings.Repeat("ж", 71), smsEncoding{encodingUCS2, 71, 2}},
+		{"ucs2 two full parts", strings.Repeat("ж", 134), smsEncoding{encodingUCS2, 134, 2}},
+		{"ucs2 one over two parts", strings.Repeat("ж", 135), smsEncoding{encodingUCS2, 135, 3}},
+		{"ucs2 from one character", strings.Repeat("a", 69) + "ж", smsEncoding{encodingUCS2, 70, 1}},
+		{"ucs2 extension takes one", strings.Repeat("€", 69) + "ж", smsEncoding{encodingUCS2, 70, 1}},
+		{"ucs2 surrogate pair takes two", strings.Repeat("😀", 35), smsEncoding{encodingUCS2, 70, 1}},
+		{"ucs2 surrogate pair over single", strings.Repeat("😀", 36), smsEncoding{encodingUCS2, 72, 2}},
+		{"ucs2 surrogate pair not split", strings.Repeat("ж", 66) + "😀" + strings.Repeat("ж", 66), smsEncoding{encodingUCS2, 134, 3}},
+		{"smart quote needs ucs2", "it’s", smsEncoding{encodingUCS2, 4, 1}},
+	}
+
+	for _, tt := range tests {
+		if got := encodeSms(tt.body); got != tt.want {
+			t.Errorf("%s: encodeSms() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransliterateSms(t *testing.T) {
+	tests := []struct {
+		body     string
+		want     string
+		encoding string
+	}{
+		{"it’s", "it's", encodingGSM7},
+		{"“Hi” – ‘you’…", "\"Hi\" - 'you'...", encodingGSM7},
+		{"a b​c • d—e", "a bc - d-e", encodingGSM7},
+		{"plain text", "plain text", encodingGSM7},
+		{"Привет, it’s me", "Привет, it's me", encodingUCS2},
+	}
+
+	for _, tt := range tests {
+		got := transliterateSms(tt.body)
+		if got != tt.want {
+			t.Errorf("transliterateSms(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+		if e := encodeSms(got).Encoding; e != tt.encoding {
+			t.Errorf("encodeSms(%q).Encoding = %s, want %s", got, e, tt.encoding)
+		}
+	}
+}
+
+func TestPrepareSmsBody(t *testing.T) {
+	defer os.Unsetenv("SMS_TRANSLITERATE")
+
+	os.Unsetenv("SMS_TRANSLITERATE")
+	if got := prepareSmsBody("it’s"); got != "it’s" {
+		t.Errorf("prepareSmsBody() without SMS_TRANSLITERATE = %q, want it unchanged", got)
+	}
+
+	os.Setenv("SMS_TRANSLITERATE", "true")
+	if got := prepareSmsBody("it’s"); got != "it's" {
+		t.Errorf("prepareSmsBody() with SMS_TRANSLITERATE = %q, want %q", got, "it's")
+	}
+}
+
+func TestEstimateSmsCost(t *testing.T) {
+	defer os.Unsetenv("SMS_SEGMENT_COST")
+	defer os.Unsetenv("SMS_COST_UNIT")
+
+	os.Unsetenv("SMS_SEGMENT_COST")
+	os.Unsetenv("SMS_COST_UNIT")
+	if cost, unit := estimateSmsCost(3); cost != 0 || unit != "USD" {
+		t.Errorf("estimateSmsCost(3) without a segment cost = %v %s, want 0 USD", cost, unit)
+	}
+
+	os.Setenv("SMS_SEGMENT_COST", "0.05")
+	os.Setenv("SMS_COST_UNIT", "SGD")
+	if cost, unit := estimateSmsCost(3); cost < 0.1499 || cost > 0.1501 || unit != "SGD" {
+		t.Errorf("estimateSmsCost(3) = %v %s, want 0.15 SGD", cost, unit)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// names of the messages sent to customers
+const (
+	templateReminder        = "reminder"
+	templateConfirmation    = "confirmation"
+	templateRetry           = "retry"
+	templateLastChance      = "last_chance"
+	templateMaxExceeded     = "max_exceeded"
+	templateInvalidReply    = "invalid_reply"
+	templateSlotsFull       = "slots_full"
+	templateWhichOrder      = "which_order"
+	templatePastDelivery    = "past_delivery"
+	templateHelp            = "help"
+	templateStatus          = "status"
+	templateCancelRequested = "cancel_requested"
+	templateOptOut          = "opt_out"
+	templateOptIn           = "opt_in"
+)
+
+// defaultTemplates is used, by locale, for every message a provider did not customise
+var defaultTemplates = map[string]map[string]string{
+	localeEnglish: {
+		templateReminder: "From: {{.ProviderTitle}} (ref {{.OrderCode}})\n" +
+			"Hello {{.CustomerName}}, your delivery is scheduled to be delivered tomorrow {{.DeliveryDate}}. " +
+			"Please state your available time slots by replying the number beside the time slot. If you’re available for more than one time slot, reply with a space between the numbers, or a dash for a range. E.g 1 2 4 or 1-3\n" +
+			"Ignore this message if it’s not meant for you.\n\n{{.SlotMenu}}",
+		templateConfirmation: "Thank you {{.CustomerName}}. The courier will be coming during your available time slots: {{.ChosenSlots}}. " +
+			"Do note that delivery might sometimes be off schedule due to unforeseen circumstances. " +
+			"Reply ‘{{.Keywords.wrong}}’ if you would like to change your available time slots. Otherwise, thank you for your time.",
+		templateRetry: "Please reply the number that represents your available time slot. " +
+			"If you’re available for more than one time slot, reply with a space between the numbers, or a dash for a range. E.g 1 2 4 or 1-3\n\n{{.SlotMenu}}",
+		templateLastChance: "Please confirm your available time slot. There will be no more changes after this. " +
+			"Please reply the number that represents your available time slot. " +
+			"If you’re available for more than one time slot, reply with a space between the numbers, or a dash for a range. E.g 1 2 4 or 1-3\n\n{{.SlotMenu}}",
+		templateMaxExceeded: "You have exceeded the number of changes. Please call {{.ProviderContact}} to confirm your delivery timings. Thank you.",
+		templateInvalidReply: "Sorry, we could not understand your reply. {{.Reason}}. " +
+			"Please reply with the numbers of your available time slots, e.g 1 2 4 or 1-3:\n\n{{.SlotMenu}}",
+		templateSlotsFull: "Sorry, the time slots you chose are fully booked. Please reply with the numbers of the time slots still available:\n\n{{.SlotMenu}}",
+		templateWhichOrder: "You have more than one delivery coming up. Please start your reply with the code of the delivery it is for, e.g {{.OrderCode}} 1 2\n\n" +
+			"{{range .Orders}}{{.OrderCode}}: {{.ProviderTitle}} on {{.DeliveryDate}}\n{{end}}",
+		templatePastDelivery: "Your delivery on {{.DeliveryDate}} is already over. Please call {{.ProviderContact}} if you need any help. Thank you.",
+		templateHelp: "From: {{.ProviderTitle}}\n" +
+			"Reply with the numbers of your available time slots, e.g 1 2 4 or 1-3. " +
+			"Reply {{.Keywords.status}} to see your delivery, {{.Keywords.wrong}} to change your time slots, " +
+			"{{.Keywords.cancel}} to cancel it or {{.Keywords.stop}} to stop receiving messages. " +
+			"For anything else please call {{.ProviderContact}}.",
+		templateStatus: "Your delivery from {{.ProviderTitle}} (ref {{.OrderCode}}) is scheduled on {{.DeliveryDate}}. " +
+			"{{if .CancelRequested}}You asked to cancel it, {{.ProviderTitle}} will contact you." +
+			"{{else if .ChosenSlots}}The courier will be coming during your available time slots: {{.ChosenSlots}}." +
+			"{{else}}You have not chosen any time slots yet.{{end}}",
+		templateCancelRequested: "We have passed your request to cancel your delivery on {{.DeliveryDate}} to {{.ProviderTitle}}. " +
+			"They will contact you shortly, or you can call {{.ProviderContact}}.",
+		templateOptOut: "You will not receive any more messages from {{.ProviderTitle}}. Reply {{.Keywords.start}} to receive them again.",
+		templateOptIn:  "You will receive messages from {{.ProviderTitle}} again. Reply {{.Keywords.stop}} to stop them.",
+	},
+	localeMalay: {
+		templateReminder: "Daripada: {{.ProviderTitle}} (ruj {{.OrderCode}})\n" +
+			"Hai {{.CustomerName}}, penghantaran anda dijadualkan esok {{.DeliveryDate}}. " +
+			"Sila nyatakan slot masa yang sesuai dengan membalas nombor di sebelah slot masa. Jika anda boleh untuk lebih daripada satu slot masa, balas dengan jarak antara nombor, atau sengkang untuk julat. Cth 1 2 4 atau 1-3\n" +
+			"Abaikan mesej ini jika ia bukan untuk anda.\n\n{{.SlotMenu}}",
+		templateConfirmation: "Terima kasih {{.CustomerName}}. Kurier akan datang dalam slot masa anda: {{.ChosenSlots}}. " +
+			"Sila ambil perhatian bahawa penghantaran mungkin lewat kerana keadaan yang tidak dijangka. " +
+			"Balas ‘{{.Keywords.wrong}}’ jika anda ingin menukar slot masa anda. Terima kasih atas masa anda.",
+		templateRetry: "Sila balas nombor slot masa yang sesuai. " +
+			"Jika anda boleh untuk lebih daripada satu slot masa, balas dengan jarak antara nombor, atau sengkang untuk julat. Cth 1 2 4 atau 1-3\n\n{{.SlotMenu}}",
+		templateLastChance: "Sila sahkan slot masa anda. Tiada lagi perubahan selepas ini. " +
+			"Sila balas nombor slot masa yang sesuai. " +
+			"Jika anda boleh untuk lebih daripada satu slot masa, balas dengan jarak antara nombor, atau sengkang untuk julat. Cth 1 2 4 atau 1-3\n\n{{.SlotMenu}}",
+		templateMaxExceeded:  "Anda telah melebihi had perubahan. Sila hubungi {{.ProviderContact}} untuk mengesahkan masa penghantaran anda. Terima kasih.",
+		templateInvalidReply: "Maaf, kami tidak faham balasan anda. {{.Reason}}. Sila balas dengan nombor slot masa yang sesuai, cth 1 2 4 atau 1-3:\n\n{{.SlotMenu}}",
+		templateSlotsFull:    "Maaf, slot masa yang anda pilih sudah penuh. Sila balas dengan nombor slot masa yang masih ada:\n\n{{.SlotMenu}}",
+		templateWhichOrder: "Anda mempunyai lebih daripada satu penghantaran. Sila mulakan balasan anda dengan kod penghantaran berkenaan, cth {{.OrderCode}} 1 2\n\n" +
+			"{{range .Orders}}{{.OrderCode}}: {{.ProviderTitle}} pada {{.DeliveryDate}}\n{{end}}",
+		templatePastDelivery: "Penghantaran anda pada {{.DeliveryDate}} telah berlalu. Sila hubungi {{.ProviderContact}} jika anda memerlukan bantuan. Terima kasih.",
+		templateHelp: "Daripada: {{.ProviderTitle}}\n" +
+			"Balas dengan nombor slot masa yang sesuai, cth 1 2 4 atau 1-3. " +
+			"Balas {{.Keywords.status}} untuk melihat penghantaran anda, {{.Keywords.wrong}} untuk menukar slot masa, " +
+			"{{.Keywords.cancel}} untuk membatalkannya atau {{.Keywords.stop}} untuk berhenti menerima mesej. " +
+			"Untuk perkara lain sila hubungi {{.ProviderContact}}.",
+		templateStatus: "Penghantaran anda daripada {{.ProviderTitle}} (ruj {{.OrderCode}}) dijadualkan pada {{.DeliveryDate}}. " +
+			"{{if .CancelRequested}}Anda telah meminta pembatalan, {{.ProviderTitle}} akan menghubungi anda." +
+			"{{else if .ChosenSlots}}Kurier akan datang dalam slot masa anda: {{.ChosenSlots}}." +
+			"{{else}}Anda belum memilih sebarang slot masa.{{end}}",
+		templateCancelRequested: "Permintaan anda untuk membatalkan penghantaran pada {{.DeliveryDate}} telah dihantar kepada {{.ProviderTitle}}. " +
+			"Mereka akan menghubungi anda tidak lama lagi, atau anda boleh hubungi {{.ProviderContact}}.",
+		templateOptOut: "Anda tidak akan menerima mesej lagi daripada {{.ProviderTitle}}. Balas {{.Keywords.start}} untuk menerimanya semula.",
+		templateOptIn:  "Anda akan menerima mesej daripada {{.ProviderTitle}} semula. Balas {{.Keywords.stop}} untuk menghentikannya.",
+	},
+	localeIndonesian: {
+		templateReminder: "Dari: {{.ProviderTitle}} (ref {{.OrderCode}})\n" +
+			"Halo {{.CustomerName}}, pengiriman Anda dijadwalkan besok {{.DeliveryDate}}. " +
+			"Silakan pilih slot waktu yang tersedia dengan membalas nomor di samping slot waktu. Jika Anda bisa di lebih dari satu slot waktu, balas dengan spasi di antara nomor, atau tanda hubung untuk rentang. Contoh 1 2 4 atau 1-3\n" +
+			"Abaikan pesan ini jika bukan untuk Anda.\n\n{{.SlotMenu}}",
+		templateConfirmation: "Terima kasih {{.CustomerName}}. Kurir akan datang pada slot waktu Anda: {{.ChosenSlots}}. " +
+			"Harap diperhatikan bahwa pengiriman terkadang bisa tidak tepat waktu karena keadaan yang tidak terduga. " +
+			"Balas ‘{{.Keywords.wrong}}’ jika Anda ingin mengubah slot waktu Anda. Terima kasih atas waktu Anda.",
+		templateRetry: "Silakan balas nomor slot waktu yang tersedia. " +
+			"Jika Anda bisa di lebih dari satu slot waktu, balas dengan spasi di antara nomor, atau tanda hubung untuk rentang. Contoh 1 2 4 atau 1-3\n\n{{.SlotMenu}}",
+		templateLastChance: "Silakan konfirmasi slot waktu Anda. Tidak ada perubahan lagi setelah ini. " +
+			"Silakan balas nomor slot waktu yang tersedia. " +
+			"Jika Anda bisa di lebih dari satu slot waktu, balas dengan spasi di antara nomor, atau tanda hubung untuk rentang. Contoh 1 2 4 atau 1-3\n\n{{.SlotMenu}}",
+		templateMaxExceeded:  "Anda telah melebihi batas perubahan. Silakan hubungi {{.ProviderContact}} untuk mengonfirmasi waktu pengiriman Anda. Terima kasih.",
+		templateInvalidReply: "Maaf, kami tidak memahami balasan Anda. {{.Reason}}. Silakan balas dengan nomor slot waktu yang tersedia, contoh 1 2 4 atau 1-3:\n\n{{.SlotMenu}}",
+		templateSlotsFull:    "Maaf, slot waktu yang Anda pilih sudah penuh. Silakan balas dengan nomor slot waktu yang masih tersedia:\n\n{{.SlotMenu}}",
+		templateWhichOrder: "Anda memiliki lebih dari satu pengiriman. Silakan awali balasan Anda dengan kode pengiriman yang dimaksud, contoh {{.OrderCode}} 1 2\n\n" +
+			"{{range .Orders}}{{.OrderCode}}: {{.ProviderTitle}} pada {{.DeliveryDate}}\n{{end}}",
+		templatePastDelivery: "Pengiriman Anda pada {{.DeliveryDate}} sudah lewat. Silakan hubungi {{.ProviderContact}} jika Anda memerlukan bantuan. Terima kasih.",
+		templateHelp: "Dari: {{.ProviderTitle}}\n" +
+			"Balas dengan nomor slot waktu yang tersedia, contoh 1 2 4 atau 1-3. " +
+			"Balas {{.Keywords.status}} untuk melihat pengiriman Anda, {{.Keywords.wrong}} untuk mengubah slot waktu, " +
+			"{{.Keywords.cancel}} untuk membatalkannya atau {{.Keywords.stop}} untuk berhenti menerima pesan. " +
+			"Untuk hal lain silakan hubungi {{.ProviderContact}}.",
+		templateStatus: "Pengiriman Anda dari {{.ProviderTitle}} (ref {{.OrderCode}}) dijadwalkan pada {{.DeliveryDate}}. " +
+			"{{if .CancelRequested}}Anda telah meminta pembatalan, {{.ProviderTitle}} akan menghubungi Anda." +
+			"{{else if .ChosenSlots}}Kurir akan datang pada slot waktu Anda: {{.ChosenSlots}}." +
+			"{{else}}Anda belum memilih slot waktu.{{end}}",
+		templateCancelRequested: "Permintaan Anda untuk membatalkan pengiriman pada {{.DeliveryDate}} telah kami teruskan ke {{.ProviderTitle}}. " +
+			"Mereka akan segera menghubungi Anda, atau Anda dapat menghubungi {{.ProviderContact}}.",
+		templateOptOut: "Anda tidak akan menerima pesan lagi dari {{.ProviderTitle}}. Balas {{.Keywords.start}} untuk menerimanya kembali.",
+		templateOptIn:  "Anda akan kembali menerima pesan dari {{.ProviderTitle}}. Balas {{.Keywords.stop}} untuk menghentikannya.",
+	},
+	localeChinese: {
+		templateReminder: "来自：{{.ProviderTitle}}（编号 {{.OrderCode}}）\n" +
+			"{{.CustomerName}}您好，您的包裹预定于明天 {{.DeliveryDate}} 送达。" +
+			"请回复时间段旁边的数字选择您方便的时间段。如果多个时间段都方便，请用空格分隔数字，或用横线表示范围。例如 1 2 4 或 1-3\n" +
+			"如果此短信不是发给您的，请忽略。\n\n{{.SlotMenu}}",
+		templateConfirmation: "谢谢您，{{.CustomerName}}。快递员将在您方便的时间段送达：{{.ChosenSlots}}。" +
+			"请注意，送货时间可能因不可预见的情况而有所变动。" +
+			"如需更改时间段，请回复“{{.Keywords.wrong}}”。感谢您的配合。",
+		templateRetry: "请回复您方便的时间段的数字。" +
+			"如果多个时间段都方便，请用空格分隔数字，或用横线表示范围。例如 1 2 4 或 1-3\n\n{{.SlotMenu}}",
+		templateLastChance: "请确认您方便的时间段，此后将无法再更改。" +
+			"请回复您方便的时间段的数字。" +
+			"如果多个时间段都方便，请用空格分隔数字，或用横线表示范围。例如 1 2 4 或 1-3\n\n{{.SlotMenu}}",
+		templateMaxExceeded:  "您的更改次数已超过上限。请致电 {{.ProviderContact}} 确认送货时间。谢谢。",
+		templateInvalidReply: "抱歉，我们无法理解您的回复。{{.Reason}}。请回复您方便的时间段的数字，例如 1 2 4 或 1-3：\n\n{{.SlotMenu}}",
+		templateSlotsFull:    "抱歉，您选择的时间段已满。请回复仍有空位的时间段的数字：\n\n{{.SlotMenu}}",
+		templateWhichOrder: "您有多个即将送达的包裹。请在回复开头加上对应包裹的编号，例如 {{.OrderCode}} 1 2\n\n" +
+			"{{range .Orders}}{{.OrderCode}}：{{.ProviderTitle}}，{{.DeliveryDate}}\n{{end}}",
+		templatePastDelivery: "您于 {{.DeliveryDate}} 的送货已结束。如需帮助，请致电 {{.ProviderContact}}。谢谢。",
+		templateHelp: "来自：{{.ProviderTitle}}\n" +
+			"请回复您方便的时间段的数字，例如 1 2 4 或 1-3。" +
+			"回复 {{.Keywords.status}} 查看送货详情，回复 {{.Keywords.wrong}} 更改时间段，" +
+			"回复 {{.Keywords.cancel}} 取消送货，回复 {{.Keywords.stop}} 停止接收短信。" +
+			"其他问题请致电 {{.ProviderContact}}。",
+		templateStatus: "您来自 {{.ProviderTitle}} 的包裹（编号 {{.OrderCode}}）预定于 {{.DeliveryDate}} 送达。" +
+			"{{if .CancelRequested}}您已申请取消，{{.ProviderTitle}} 将与您联系。" +
+			"{{else if .ChosenSlots}}快递员将在您方便的时间段送达：{{.ChosenSlots}}。" +
+			"{{else}}您尚未选择任何时间段。{{end}}",
+		templateCancelRequested: "我们已将您取消 {{.DeliveryDate}} 送货的申请转达给 {{.ProviderTitle}}。" +
+			"他们将尽快与您联系，您也可以致电 {{.ProviderContact}}。",
+		templateOptOut: "您将不再收到来自 {{.ProviderTitle}} 的短信。回复 {{.Keywords.start}} 可重新接收。",
+		templateOptIn:  "您将重新收到来自 {{.ProviderTitle}} 的短信。回复 {{.Keywords.stop}} 可停止接收。",
+	},
+}
+
+// smsTemplateData is what templates can refer to, e.g. {{.CustomerName}}.
+// Keywords are the ones to mention for each intent, e.g. {{.Keywords.wrong}}.
+// Reason is why a reply could not be read, in the locale of the customer.
+type smsTemplateData struct {
+	CustomerName    string
+	OrderCode       string
+	DeliveryDate    string
+	ProviderTitle   string
+	ProviderContact string
+	SlotMenu        string
+	ChosenSlots     string
+	CancelRequested bool
+	Reason          string
+	Keywords        map[string]string
+	Orders          []*smsTemplateData
+}
+
+// smsPreview is a rendered template with how it would be billed.
+// Transliterated is the body actually sent when SMS_TRANSLITERATE is true.
+type smsPreview struct {
+	Name           string  `json:"name" schema:"name"`
+	Locale         string  `json:"locale" schema:"locale"`
+	Body           string  `json:"body" schema:"body"`
+	Length         int     `json:"length"`
+	Encoding       string  `json:"encoding"`
+	Segments       int     `json:"segments"`
+	EstimatedCost  float64 `json:"estimated_cost"`
+	CostUnit       string  `json:"cost_unit"`
+	Transliterated string  `json:"transliterated,omitempty"`
+}
+
+// newSmsTemplateData fill the template data of an order, in the locale of its customer
+// order must have Provider populated
+func newSmsTemplateData(o *order) (*smsTemplateData, error) {
+	deliveryDate, err := generateGoDateFromString(o.DeliveryDate, "0", o.Provider.location())
+	if err != nil {
+		return nil, err
+	}
+
+	chosenSlots := []string{}
+	for _, c := range o.Choices {
+		chosenSlots = append(chosenSlots, c.TimeSlot.String())
+	}
+
+	return &smsTemplateData{
+		CustomerName:    o.CustomerName,
+		OrderCode:       o.Code,
+		DeliveryDate:    formatDate(deliveryDate, o.locale()),
+		ProviderTitle:   o.Provider.Title,
+		ProviderContact: o.Provider.ContactNumber,
+		SlotMenu:        slotMenu(o.Provider.Slots),
+		ChosenSlots:     strings.Join(chosenSlots, ", "),
+		CancelRequested: o.ConversationState == stateCancelRequested,
+		Keywords:        o.Provider.Keywords.mentions(o.locale()),
+	}, nil
+}
+
+// renderOrderSms render a message about an order with the template of its provider
+// in the locale of its customer
+// order must have Provider populated
+func renderOrderSms(o *order, name string) (string, error) {
+	data, err := newSmsTemplateData(o)
+	if err != nil {
+		return "", err
+	}
+	return renderSms(o.Provider, o.locale(), name, data)
+}
+
+// renderSms render the template of a provider in locale, or the default one if it has none
+func renderSms(p *provider, locale, name string, data *smsTemplateData) (string, error) {
+	body, err := fetchTemplate(p.ID, locale, name)
+	if err != nil {
+		return "", err
+	}
+	return executeTemplate(name, body, data)
+}
+
+func executeTemplate(name, body string, data *smsTemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// sampleSmsTemplateData fill template data with a made up order of a provider in locale,
+// using its slots when it has some
+func sampleSmsTemplateData(p *provider, locale string) (*smsTemplateData, error) {
+	if len(p.Slots) == 0 {
+		p.Slots = []*timeSlot{
+			&timeSlot{StartTime: clockTime{Hour: 9}, EndTime: clockTime{Hour: 12}},
+			&timeSlot{StartTime: clockTime{Hour: 12}, EndTime: clockTime{Hour: 15}},
+			&timeSlot{StartTime: clockTime{Hour: 15}, EndTime: clockTime{Hour: 18}},
+		}
+	}
+	o := &order{
+		CustomerName:  "Jane Tan",
+		ContactNumber: "+6591234567",
+		DeliveryDate:  time.Now().In(p.location()).AddDate(0, 0, 1).Format("2006-01-02"),
+		Code:          "ABCD",
+		Locale:        locale,
+		Provider:      p,
+	}
+	for _, s := range p.Slots {
+		o.Choices = append(o.Choices, &choice{TimeSlot: s})
+	}
+
+	data, err := newSmsTemplateData(o)
+	if err != nil {
+		return nil, err
+	}
+	data.Reason = (&slotReplyError{Reason: slotReplyNotASlot, Value: "7"}).localized(locale)
+	data.Orders = []*smsTemplateData{data}
+	return data, nil
+}
+
+// GET /api/provider/:id/templates?locale=
+// every message with the template in effect, custom when the provider overrides the default one.
+// locale is English by default.
+func getProviderTemplates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = localeEnglish
+	}
+	if !isSupportedLocale(locale) {
+		http.Error(w, "Unknown locale "+locale, 400)
+		return
+	}
+	renderProviderTemplates(w, int64(ID), locale)
+}
+
+func renderProviderTemplates(w http.ResponseWriter, providerID int64, locale string) {
+	custom, err := fetchTemplates(providerID, locale)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	templates := map[string]map[string]interface{}{}
+	for name, body := range defaultTemplates[locale] {
+		customBody, ok := custom[name]
+		if ok {
+			body = customBody
+		}
+		templates[name] = map[string]interface{}{"body": body, "custom": ok}
+	}
+
+	RenderJSON(w, map[string]interface{}{"locale": locale, "templates": templates})
+}
+
+// PUT /api/provider/:id/templates
+// {"locale": "ms", "templates": {"max_exceeded": "..."}} replace the templates given,
+// an empty template restore the default one. locale is English by default.
+func setProviderTemplates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	body := struct {
+		Locale    string            `json:"locale"`
+		Templates map[string]string `json:"templates"`
+	}{}
+	if err := ReadRequestBody(r, &body); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if body.Locale == "" {
+		body.Locale = localeEnglish
+	}
+	if !isSupportedLocale(body.Locale) {
+		http.Error(w, "Unknown locale "+body.Locale, 400)
+		return
+	}
+
+	p, err := fetchProviderForTemplates(int64(ID))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	sample, err := sampleSmsTemplateData(p, body.Locale)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for name, tmpl := range body.Templates {
+		if _, ok := defaultTemplates[localeEnglish][name]; !ok {
+			http.Error(w, "Unknown template "+name, 400)
+			return
+		}
+		if _, err := executeTemplate(name, tmpl, sample); tmpl != "" && err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for name, tmpl := range body.Templates {
+		if err := saveTemplate(tx, int64(ID), body.Locale, name, tmpl); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	renderProviderTemplates(w, int64(ID), body.Locale)
+}
+
+// POST /api/provider/:id/templates/preview
+// render the template called name in locale, or body when given, against a sample order.
+// locale is the provider default one if empty.
+func previewProviderTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	preview := smsPreview{}
+	if err := ReadRequestBody(r, &preview); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, ok := defaultTemplates[localeEnglish][preview.Name]; !ok {
+		http.Error(w, "Unknown template "+preview.Name, 400)
+		return
+	}
+
+	p, err := fetchProviderForTemplates(int64(ID))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if p == nil {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	if preview.Locale == "" {
+		preview.Locale = (&order{Provider: p}).locale()
+	}
+	if !isSupportedLocale(preview.Locale) {
+		http.Error(w, "Unknown locale "+preview.Locale, 400)
+		return
+	}
+	sample, err := sampleSmsTemplateData(p, preview.Locale)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if preview.Body == "" {
+		preview.Body, err = fetchTemplate(p.ID, preview.Locale, preview.Name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	preview.Body, err = executeTemplate(preview.Name, preview.Body, sample)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	preview.Length = utf8.RuneCountInString(preview.Body)
+	sent := prepareSmsBody(preview.Body)
+	if sent != preview.Body {
+		preview.Transliterated = sent
+	}
+	e := encodeSms(sent)
+	preview.Encoding = e.Encoding
+	preview.Segments = e.Segments
+	preview.EstimatedCost, preview.CostUnit = estimateSmsCost(preview.Segments)
+
+	RenderJSON(w, preview)
+}
+
+// fetchProviderForTemplates return a provider with its Keywords and Slots, nil if there is none
+func fetchProviderForTemplates(providerID int64) (*provider, error) {
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	if err != nil || len(providers) == 0 {
+		return nil, err
+	}
+	p := providers[0]
+
+	p.Keywords, err = fetchKeywords(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC`
+	p.Slots, err = fetchTimeSlots(query, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fetchTemplate return the template of a provider in locale, or the default one if it has none
+func fetchTemplate(providerID int64, locale, name string) (string, error) {
+	body, ok := defaultTemplates[locale][name]
+	if !ok {
+		return "", errors.New("Unknown template " + name + " in " + locale)
+	}
+
+	var customBody string
+	query := `SELECT body FROM provider_templates WHERE provider_id = $1 AND locale = $2 AND name = $3`
+	err := dbConn.QueryRow(query, providerID, locale, name).Scan(&customBody)
+	if err == sql.ErrNoRows {
+		return body, nil
+	}
+	return customBody, err
+}
+
+// fetchTemplates return the templates a provider overrides in locale by name
+func fetchTemplates(providerID int64, locale string) (map[string]string, error) {
+	rows, err := dbConn.Query(`SELECT name, body FROM provider_templates WHERE provider_id = $1 AND locale = $2`, providerID, locale)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := map[string]string{}
+	for rows.Next() {
+		var name, body string
+		if err := rows.Scan(&name, &body); err != nil {
+			return nil, err
+		}
+		templates[name] = body
+	}
+	return templates, nil
+}
+
+// saveTemplate override a template of a provider in locale, or remove the override if body is empty
+func saveTemplate(tx *sql.Tx, providerID int64, locale, name, body string) error {
+	if body == "" {
+		_, err := tx.Exec(`DELETE FROM provider_templates WHERE provider_id = $1 AND locale = $2 AND name = $3`, providerID, locale, name)
+		return err
+	}
+
+	query := `
+		INSERT INTO provider_templates(provider_id, locale, name, body) VALUES($1, $2, $3, $4)
+		ON CONFLICT (provider_id, locale, name) DO UPDATE SET body = EXCLUDED.body, updated_at = NOW()
+	`
+	_, err := tx.Exec(query, providerID, locale, name, body)
+	return err
+}
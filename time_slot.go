@@ -1,32 +1,93 @@
 package main
 
 import (
+	"database/sql"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
 )
 
+// timeSlot times are wall clock times in the provider timezone.
+// A nil Capacity means unlimited.
+// Remaining is only known when fetched for a delivery date.
+// A slot applies every day unless scoped with DaysOfWeek (0 is Sunday)
+// and/or an inclusive ValidFrom/ValidUntil date range.
+// On the days an Overrides slot applies, only the other Overrides slots apply along with it,
+// e.g. for a public holiday schedule.
 type timeSlot struct {
-	ID         int64  `json:"id"`
-	StartTime  string `json:"start_time" schema:"start_time"`
-	EndTime    string `json:"end_time" schema:"end_time"`
-	ProviderID int64  `json:"provider_id" schema:"provider_id"`
+	ID         int64     `json:"id"`
+	StartTime  clockTime `json:"start_time" schema:"start_time"`
+	EndTime    clockTime `json:"end_time" schema:"end_time"`
+	ProviderID int64     `json:"provider_id" schema:"provider_id"`
+	Capacity   *int64    `json:"capacity" schema:"capacity"`
+	Remaining  *int64    `json:"remaining,omitempty"`
+	DaysOfWeek []int64   `json:"days_of_week,omitempty" schema:"days_of_week"`
+	ValidFrom  string    `json:"valid_from,omitempty" schema:"valid_from"`
+	ValidUntil string    `json:"valid_until,omitempty" schema:"valid_until"`
+	Overrides  bool      `json:"overrides" schema:"overrides"`
+}
+
+type slotCapacity struct {
+	Capacity     *int64 `json:"capacity" schema:"capacity"`
+	DeliveryDate string `json:"delivery_date" schema:"delivery_date"`
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// isFull report whether no more choices can be made on the slot
+func (s *timeSlot) isFull() bool {
+	return s.Remaining != nil && *s.Remaining <= 0
+}
+
+// String render the slot as "HH:MM-HH:MM"
+func (s *timeSlot) String() string {
+	return s.StartTime.String() + "-" + s.EndTime.String()
 }
 
 // POST /api/time_slot
+// overrides needs valid_from or valid_until, the slot then replaces every slot without overrides
+// on the dates it applies. Other scoped slots are offered along with the regular ones.
 func createNewTimeSlot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	s := timeSlot{}
 	if err := ReadRequestBody(r, &s); err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	if s.StartTime >= s.EndTime {
+	if !s.StartTime.Before(s.EndTime) {
 		http.Error(w, "Invalid Time Slot", 400)
 		return
 	}
+	if s.Capacity != nil && *s.Capacity < 0 {
+		http.Error(w, "Invalid capacity", 400)
+		return
+	}
+	for _, day := range s.DaysOfWeek {
+		if day < 0 || day > 6 {
+			http.Error(w, "Invalid day of week", 400)
+			return
+		}
+	}
+	for _, date := range []string{s.ValidFrom, s.ValidUntil} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			http.Error(w, "Invalid date "+date, 400)
+			return
+		}
+	}
+	if s.ValidFrom != "" && s.ValidUntil != "" && s.ValidFrom > s.ValidUntil {
+		http.Error(w, "Invalid date range", 400)
+		return
+	}
+	if s.Overrides && s.ValidFrom == "" && s.ValidUntil == "" {
+		http.Error(w, "An overriding slot needs a date range", 400)
+		return
+	}
 
-	providers, err := fetchProviders(`SELECT id, title, contact_number, reminder_time FROM providers WHERE id = $1 AND NOT deleted`, s.ProviderID)
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, s.ProviderID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -36,9 +97,16 @@ func createNewTimeSlot(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		return
 	}
 
-	query := `INSERT INTO time_slots(start_time, end_time, provider_id) VALUES($1, $2, $3) RETURNING id`
+	query := `
+		INSERT INTO time_slots(start_time, end_time, provider_id, capacity, days_of_week, valid_from, valid_until, overrides)
+		VALUES($1, $2, $3, $4, $5, NULLIF($6, '')::date, NULLIF($7, '')::date, $8) RETURNING id
+	`
+	var daysOfWeek interface{}
+	if len(s.DaysOfWeek) > 0 {
+		daysOfWeek = pq.Array(s.DaysOfWeek)
+	}
 	var id int64
-	err = dbConn.QueryRow(query, s.StartTime, s.EndTime, s.ProviderID).Scan(&id)
+	err = dbConn.QueryRow(query, s.StartTime, s.EndTime, s.ProviderID, s.Capacity, daysOfWeek, s.ValidFrom, s.ValidUntil, s.Overrides).Scan(&id)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -47,11 +115,13 @@ func createNewTimeSlot(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	RenderJSON(w, map[string]int64{"id": id})
 }
 
-// GET /api/time_slot/:provider_id
+// GET /api/time_slot/:provider_id?date=YYYY-MM-DD
+// with a date, only the slots in effect that day are returned along with their remaining room:
+// the overriding slots that apply if there are any, otherwise every slot that applies
 func getTimeSlotsByProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	providerID, _ := strconv.Atoi(ps.ByName("provider_id"))
 
-	providers, err := fetchProviders(`SELECT id, title, contact_number, reminder_time FROM providers WHERE id = $1 AND NOT deleted`, providerID)
+	providers, err := fetchProviders(`SELECT id, title, contact_number, to_char(reminder_time, 'HH24:MI'), timezone, quiet_hours_start, quiet_hours_end, default_locale FROM providers WHERE id = $1 AND NOT deleted`, providerID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -61,7 +131,22 @@ func getTimeSlotsByProvider(w http.ResponseWriter, r *http.Request, ps httproute
 		return
 	}
 
-	query := `SELECT id, start_time, end_time, provider_id FROM time_slots WHERE provider_id = $1 AND NOT deleted`
+	if date := r.URL.Query().Get("date"); date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "Invalid date", 400)
+			return
+		}
+		slots, err := fetchTimeSlotsForDate(dbConn, int64(providerID), date, 0)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		RenderJSON(w, map[string][]*timeSlot{"slots": slots})
+		return
+	}
+
+	query := `SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE provider_id = $1 AND NOT deleted ORDER BY start_time ASC`
 	slots, err := fetchTimeSlots(query, providerID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -71,6 +156,60 @@ func getTimeSlotsByProvider(w http.ResponseWriter, r *http.Request, ps httproute
 	RenderJSON(w, map[string][]*timeSlot{"slots": slots})
 }
 
+// PUT /api/time_slot/:id/capacity
+// sets the default capacity of the slot, or only the one of delivery_date if given.
+// An empty capacity means unlimited, or back to the default for a delivery date.
+func setTimeSlotCapacity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ID, _ := strconv.Atoi(ps.ByName("id"))
+	c := slotCapacity{}
+	if err := ReadRequestBody(r, &c); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if c.Capacity != nil && *c.Capacity < 0 {
+		http.Error(w, "Invalid capacity", 400)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", c.DeliveryDate); c.DeliveryDate != "" && err != nil {
+		http.Error(w, "Invalid date "+c.DeliveryDate, 400)
+		return
+	}
+
+	slots, err := fetchTimeSlots(`SELECT id, start_time, end_time, provider_id, capacity, days_of_week, to_char(valid_from, 'YYYY-MM-DD'), to_char(valid_until, 'YYYY-MM-DD'), overrides FROM time_slots WHERE id = $1 AND NOT deleted`, ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(slots) == 0 {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	query := `UPDATE time_slots SET capacity = $2 WHERE id = $1`
+	args := []interface{}{ID, c.Capacity}
+	if c.DeliveryDate != "" && c.Capacity == nil {
+		query = `DELETE FROM time_slot_capacities WHERE time_slot_id = $1 AND delivery_date = $2`
+		args = []interface{}{ID, c.DeliveryDate}
+	} else if c.DeliveryDate != "" {
+		query = `
+			INSERT INTO time_slot_capacities(time_slot_id, delivery_date, capacity) VALUES($1, $2, $3)
+			ON CONFLICT (time_slot_id, delivery_date) DO UPDATE SET capacity = EXCLUDED.capacity
+		`
+		args = []interface{}{ID, c.DeliveryDate, c.Capacity}
+	}
+	stmt, err := dbConn.Prepare(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, err := stmt.Exec(args...); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string]string{})
+}
+
 // DELETE /api/time_slot/:id
 func deleteTimeSlot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ID, _ := strconv.Atoi(ps.ByName("id"))
@@ -110,10 +249,75 @@ func fetchTimeSlots(query string, args ...interface{}) ([]*timeSlot, error) {
 	results := make([]*timeSlot, 0)
 	for rows.Next() {
 		s := new(timeSlot)
-		err = rows.Scan(&s.ID, &s.StartTime, &s.EndTime, &s.ProviderID)
+		var capacity sql.NullInt64
+		var validFrom, validUntil sql.NullString
+		err = rows.Scan(&s.ID, &s.StartTime, &s.EndTime, &s.ProviderID, &capacity, pq.Array(&s.DaysOfWeek), &validFrom, &validUntil, &s.Overrides)
+		if err != nil {
+			return nil, err
+		}
+		if capacity.Valid {
+			s.Capacity = &capacity.Int64
+		}
+		s.ValidFrom = validFrom.String
+		s.ValidUntil = validUntil.String
+
+		results = append(results, s)
+	}
+
+	return results, nil
+}
+
+// fetchTimeSlotsForDate return the slots of a provider in effect on deliveryDate ('YYYY-MM-DD')
+// with their capacity and remaining room that day.
+// Overriding slots that apply on deliveryDate replace all the others, so that
+// e.g. a public holiday schedule overrides the regular one.
+// Choices of excludedOrderID are not counted, so that an order can pick its own slots again.
+func fetchTimeSlotsForDate(q queryer, providerID int64, deliveryDate string, excludedOrderID int64) ([]*timeSlot, error) {
+	query := `
+		WITH effective AS (
+			SELECT * FROM time_slots
+			WHERE provider_id = $1 AND NOT deleted
+			AND (days_of_week IS NULL OR EXTRACT(DOW FROM $2::date)::smallint = ANY(days_of_week))
+			AND (valid_from IS NULL OR valid_from <= $2::date)
+			AND (valid_until IS NULL OR valid_until >= $2::date)
+		)
+		SELECT time_slots.id, time_slots.start_time, time_slots.end_time, time_slots.provider_id,
+		COALESCE(time_slot_capacities.capacity, time_slots.capacity),
+		time_slots.days_of_week, to_char(time_slots.valid_from, 'YYYY-MM-DD'), to_char(time_slots.valid_until, 'YYYY-MM-DD'), time_slots.overrides,
+		(
+			SELECT COUNT(*) FROM choices INNER JOIN orders ON orders.id = choices.order_id
+			WHERE choices.time_slot_id = time_slots.id AND NOT choices.deleted
+			AND NOT orders.deleted AND orders.delivery_date = $2 AND orders.id <> $3
+		)
+		FROM effective time_slots
+		LEFT JOIN time_slot_capacities
+		ON time_slot_capacities.time_slot_id = time_slots.id AND time_slot_capacities.delivery_date = $2
+		WHERE time_slots.overrides OR NOT EXISTS (SELECT 1 FROM effective WHERE overrides)
+		ORDER BY time_slots.start_time ASC
+	`
+	rows, err := q.Query(query, providerID, deliveryDate, excludedOrderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*timeSlot, 0)
+	for rows.Next() {
+		s := new(timeSlot)
+		var capacity sql.NullInt64
+		var validFrom, validUntil sql.NullString
+		var taken int64
+		err = rows.Scan(&s.ID, &s.StartTime, &s.EndTime, &s.ProviderID, &capacity, pq.Array(&s.DaysOfWeek), &validFrom, &validUntil, &s.Overrides, &taken)
 		if err != nil {
 			return nil, err
 		}
+		s.ValidFrom = validFrom.String
+		s.ValidUntil = validUntil.String
+		if capacity.Valid {
+			remaining := capacity.Int64 - taken
+			s.Capacity = &capacity.Int64
+			s.Remaining = &remaining
+		}
 
 		results = append(results, s)
 	}
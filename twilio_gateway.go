@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// twilioGateway send sms through the Twilio REST API
+// configured by TWILIO_SID, TWILIO_TOKEN and TWILIO_NUMBER.
+type twilioGateway struct{}
+
+type twilioMessage struct {
+	SID       string  `json:"sid"`
+	Status    string  `json:"status"`
+	Price     *string `json:"price"`
+	PriceUnit string  `json:"price_unit"`
+}
+
+type twilioError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+func (g *twilioGateway) Name() string {
+	return "twilio"
+}
+
+func (g *twilioGateway) Send(toNumber string, body string) (*SendResult, error) {
+	resp, err := sendWithTwilio(toNumber, body)
+	if err != nil {
+		return nil, &gatewayError{msg: err.Error(), retryable: true}
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &gatewayError{msg: err.Error(), retryable: true}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Twilio being down is worth another gateway, a rejected message is not
+		gErr := &gatewayError{msg: "Twilio responded " + resp.Status, retryable: resp.StatusCode >= 500}
+		tErr := twilioError{}
+		if err := json.Unmarshal(b, &tErr); err == nil && tErr.Message != "" {
+			gErr.msg = "Twilio error " + strconv.Itoa(tErr.Code) + ": " + tErr.Message
+		}
+		return nil, gErr
+	}
+
+	m := twilioMessage{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	result := &SendResult{MessageID: m.SID, Status: m.Status, CostUnit: m.PriceUnit}
+	// price is only known once Twilio has billed the message, and is negative
+	if m.Price != nil {
+		if price, err := strconv.ParseFloat(*m.Price, 64); err == nil {
+			result.Cost = math.Abs(price)
+		}
+	}
+
+	return result, nil
+}
+
+// sendWithTwilio post a message to Twilio.
+// Delivery updates are requested to /api/sms/status when PUBLIC_BASE_URL is set.
+func sendWithTwilio(toNumber string, body string) (*http.Response, error) {
+	urlStr := "https://api.twilio.com/2010-04-01/Accounts/" + os.Getenv("TWILIO_SID") + "/Messages.json"
+	msgData := url.Values{}
+	msgData.Set("From", os.Getenv("TWILIO_NUMBER"))
+	msgData.Set("To", toNumber)
+	msgData.Set("Body", body)
+	if baseURL := os.Getenv("PUBLIC_BASE_URL"); baseURL != "" {
+		msgData.Set("StatusCallback", strings.TrimRight(baseURL, "/")+"/api/sms/status")
+	}
+	msgDataReader := *strings.NewReader(msgData.Encode())
+
+	req, err := http.NewRequest("POST", urlStr, &msgDataReader)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(os.Getenv("TWILIO_SID"), os.Getenv("TWILIO_TOKEN"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	return httpsClient.Do(req)
+}
+
+// requireTwilioSignature reject webhook requests not signed by Twilio with 403.
+// Set TWILIO_SKIP_SIGNATURE=true together with GO_ENV=development to bypass the check locally.
+func requireTwilioSignature(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if os.Getenv("GO_ENV") == "development" && os.Getenv("TWILIO_SKIP_SIGNATURE") == "true" {
+			next(w, r, ps)
+			return
+		}
+
+		// the parsed form stays on the request for ReadRequestBody
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		signature := r.Header.Get("X-Twilio-Signature")
+		if signature == "" || !validTwilioSignature(signature, twilioRequestURL(r), r.PostForm) {
+			log.Println("Rejected unsigned Twilio webhook to", r.URL.Path, "from", r.RemoteAddr)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		next(w, r, ps)
+	}
+}
+
+// validTwilioSignature compare signature with the HMAC-SHA1 Twilio computes over
+// the full request URL followed by every POST param name and value sorted by name
+func validTwilioSignature(signature, fullURL string, params url.Values) bool {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	payload := fullURL
+	for _, k := range keys {
+		values := append([]string{}, params[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			payload += k + v
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(os.Getenv("TWILIO_TOKEN")))
+	mac.Write([]byte(payload))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// twilioRequestURL rebuild the URL Twilio called.
+// PUBLIC_BASE_URL takes precedence as the service usually sits behind a proxy.
+func twilioRequestURL(r *http.Request) string {
+	if baseURL := os.Getenv("PUBLIC_BASE_URL"); baseURL != "" {
+		return strings.TrimRight(baseURL, "/") + r.URL.RequestURI()
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// twilioTestURL and twilioTestParams are the example of Twilio's security documentation,
+// signed with the auth token 12345
+const twilioTestURL = "https://mycompany.com/myapp.php?foo=1&bar=2"
+const twilioTestSignature = "GvWf1cFY/Q7PnoempGyD5oXAezc="
+
+func twilioTestParams() url.Values {
+	return url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+14158675310"},
+		"Digits":  {"1234"},
+		"From":    {"+14158675310"},
+		"To":      {"+18005551212"},
+	}
+}
+
+func TestValidTwilioSignature(t *testing.T) {
+	os.Setenv("TWILIO_TOKEN", "12345")
+	defer os.Unsetenv("TWILIO_TOKEN")
+
+	tampered := twilioTestParams()
+	tampered.Set("Digits", "4321")
+	extra := twilioTestParams()
+	extra.Set("Body", "1")
+
+	tests := []struct {
+		name      string
+		signature string
+		fullURL   string
+		params    url.Values
+		want      bool
+	}{
+		{"known good", twilioTestSignature, twilioTestURL, twilioTestParams(), true},
+		{"tampered param", twilioTestSignature, twilioTestURL, tampered, false},
+		{"added param", twilioTestSignature, twilioTestURL, extra, false},
+		{"tampered url", twilioTestSignature, "https://mycompany.com/myapp.php?foo=1&bar=3", twilioTestParams(), false},
+		{"other scheme", twilioTestSignature, strings.Replace(twilioTestURL, "https", "http", 1), twilioTestParams(), false},
+		{"tampered signature", "HvWf1cFY/Q7PnoempGyD5oXAezc=", twilioTestURL, twilioTestParams(), false},
+		{"empty signature", "", twilioTestURL, twilioTestParams(), false},
+	}
+
+	for _, tt := range tests {
+		if got := validTwilioSignature(tt.signature, tt.fullURL, tt.params); got != tt.want {
+			t.Errorf("%s: validTwilioSignature() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	os.Setenv("TWILIO_TOKEN", "54321")
+	if validTwilioSignature(twilioTestSignature, twilioTestURL, twilioTestParams()) {
+		t.Error("validTwilioSignature() accepted a signature made with another token")
+	}
+}
+
+func TestRequireTwilioSignature(t *testing.T) {
+	os.Setenv("TWILIO_TOKEN", "12345")
+	defer os.Unsetenv("TWILIO_TOKEN")
+
+	handled := false
+	handler := requireTwilioSignature(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handled = true
+	})
+
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		wantCode  int
+	}{
+		{"known good", twilioTestSignature, twilioTestParams().Encode(), 200},
+		{"tampered body", twilioTestSignature, strings.Replace(twilioTestParams().Encode(), "1234", "4321", 1), 403},
+		{"no signature", "", twilioTestParams().Encode(), 403},
+	}
+
+	for _, tt := range tests {
+		handled = false
+		r := httptest.NewRequest("POST", twilioTestURL, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.signature != "" {
+			r.Header.Set("X-Twilio-Signature", tt.signature)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+
+		if w.Code != tt.wantCode || handled != (tt.wantCode == 200) {
+			t.Errorf("%s: responded %d and handled = %v, want %d", tt.name, w.Code, handled, tt.wantCode)
+		}
+	}
+}
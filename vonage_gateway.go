@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/julienschmidt/httprouter"
+)
+
+// vonageGateway send sms through the Vonage (Nexmo) SMS API
+// configured by VONAGE_API_KEY, VONAGE_API_SECRET and VONAGE_NUMBER.
+// baseURL is VONAGE_BASE_URL so that a local stand-in can take the place of the live API.
+type vonageGateway struct {
+	baseURL string
+}
+
+type vonageResponse struct {
+	MessageCount string           `json:"message-count"`
+	Messages     []*vonageMessage `json:"messages"`
+}
+
+// vonageMessage is one part of a message, long ones are split by Vonage
+type vonageMessage struct {
+	MessageID    string `json:"message-id"`
+	Status       string `json:"status"`
+	MessagePrice string `json:"message-price"`
+	ErrorText    string `json:"error-text"`
+}
+
+// vonageInbound is a message received by the Vonage number
+type vonageInbound struct {
+	MSISDN    string `schema:"msisdn"`
+	To        string `schema:"to"`
+	Text      string `schema:"text"`
+	MessageID string `schema:"messageId"`
+}
+
+// vonageReceipt is a delivery receipt of one part of a message
+type vonageReceipt struct {
+	MessageID string `schema:"messageId"`
+	Status    string `schema:"status"`
+	ErrCode   string `schema:"err-code"`
+}
+
+// vonageStatuses map Vonage delivery receipt statuses to the Twilio ones used in the message log
+var vonageStatuses = map[string]string{
+	"accepted":  "sent",
+	"buffered":  "sent",
+	"delivered": messageStatusDelivered,
+	"expired":   messageStatusUndelivered,
+	"failed":    messageStatusFailed,
+	"rejected":  messageStatusFailed,
+	"unknown":   "sent",
+}
+
+// vonageRetryableStatuses are send failures of Vonage itself: throttled, internal error and out of credit
+var vonageRetryableStatuses = map[string]bool{"1": true, "5": true, "9": true}
+
+// newVonageGateway use VONAGE_BASE_URL, https://rest.nexmo.com by default
+func newVonageGateway() *vonageGateway {
+	baseURL := os.Getenv("VONAGE_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://rest.nexmo.com"
+	}
+	return &vonageGateway{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (g *vonageGateway) Name() string {
+	return "vonage"
+}
+
+// Send post a message to Vonage.
+// The result carries the ID of the first part, and those of the other parts of a long message
+// so that their receipts are matched too.
+// When only some parts were accepted, their IDs come back along with an error that is not
+// retryable, since sending again would send those parts twice.
+func (g *vonageGateway) Send(toNumber string, body string) (*SendResult, error) {
+	msgData := url.Values{}
+	msgData.Set("api_key", os.Getenv("VONAGE_API_KEY"))
+	msgData.Set("api_secret", os.Getenv("VONAGE_API_SECRET"))
+	msgData.Set("from", os.Getenv("VONAGE_NUMBER"))
+	msgData.Set("to", strings.TrimPrefix(toNumber, "+"))
+	msgData.Set("text", body)
+	if encodeSms(body).Encoding == encodingUCS2 {
+		msgData.Set("type", "unicode")
+	}
+	if baseURL := os.Getenv("PUBLIC_BASE_URL"); baseURL != "" {
+		msgData.Set("status-report-req", "1")
+		msgData.Set("callback", strings.TrimRight(baseURL, "/")+"/api/sms/vonage/status")
+	}
+
+	resp, err := httpsClient.PostForm(g.baseURL+"/sms/json", msgData)
+	if err != nil {
+		return nil, &gatewayError{msg: err.Error(), retryable: true}
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &gatewayError{msg: err.Error(), retryable: true}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &gatewayError{msg: "Vonage responded " + resp.Status, retryable: resp.StatusCode >= 500}
+	}
+
+	vResp := vonageResponse{}
+	if err := json.Unmarshal(b, &vResp); err != nil {
+		return nil, err
+	}
+	if len(vResp.Messages) == 0 {
+		return nil, &gatewayError{msg: "Vonage accepted no message", retryable: true}
+	}
+
+	// Vonage bills in euros, per part
+	result := &SendResult{Status: "sent", CostUnit: "EUR"}
+	var failed *vonageMessage
+	for _, m := range vResp.Messages {
+		if m.Status != "0" {
+			if failed == nil {
+				failed = m
+			}
+			continue
+		}
+		if result.MessageID == "" {
+			result.MessageID = m.MessageID
+		} else {
+			result.PartIDs = append(result.PartIDs, m.MessageID)
+		}
+		if price, err := strconv.ParseFloat(m.MessagePrice, 64); err == nil {
+			result.Cost += math.Abs(price)
+		}
+	}
+
+	if failed != nil {
+		err := &gatewayError{
+			msg:       "Vonage error " + failed.Status + ": " + failed.ErrorText,
+			retryable: vonageRetryableStatuses[failed.Status],
+		}
+		if result.MessageID == "" {
+			return nil, err
+		}
+		err.retryable = false
+		return result, err
+	}
+	return result, nil
+}
+
+// GET|POST /api/sms/vonage/reply
+// Vonage inbound message webhook.
+// Vonage retries until it gets a 200, which it gets once the message is recorded.
+// A messageId already recorded is not handled again.
+func respondToVonageSms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	in := vonageInbound{}
+	if err := readVonageParams(r, &in); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if in.MSISDN == "" || in.Text == "" {
+		log.Println("Ignored Vonage message", in.MessageID, "without sender or text")
+		return
+	}
+
+	s := sms{From: "+" + in.MSISDN, To: "+" + in.To, Body: in.Text, Gateway: "vonage", GatewaySID: in.MessageID}
+	if err := receiveSms(s); err == errNoOrderFound {
+		log.Println("Ignored Vonage message", in.MessageID, "from", s.From+":", err.Error())
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// GET|POST /api/sms/vonage/status
+// Vonage delivery receipt webhook
+func updateVonageSmsStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rc := vonageReceipt{}
+	if err := readVonageParams(r, &rc); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if rc.MessageID == "" || rc.Status == "" {
+		http.Error(w, "Invalid Delivery Receipt", 400)
+		return
+	}
+
+	status, ok := vonageStatuses[rc.Status]
+	if !ok {
+		http.Error(w, "Unknown Delivery Status "+rc.Status, 400)
+		return
+	}
+	errStr := ""
+	if rc.ErrCode != "" && rc.ErrCode != "0" {
+		errStr = "Vonage error " + rc.ErrCode
+	}
+	if err := updateMessageStatus(rc.MessageID, status, errStr); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	RenderJSON(w, map[string]string{})
+}
+
+// readVonageParams bind webhook params to i.
+// Vonage sends them as a query string, a form or a JSON object depending on the account settings.
+func readVonageParams(r *http.Request, i interface{}) error {
+	params, err := vonageParams(r)
+	if err != nil {
+		return err
+	}
+
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	return decoder.Decode(i, params)
+}
+
+// vonageParams parse webhook params once and keep them as r.Form
+func vonageParams(r *http.Request) (url.Values, error) {
+	if r.Form != nil {
+		return r.Form, nil
+	}
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		err := r.ParseForm()
+		return r.Form, err
+	}
+
+	obj := map[string]interface{}{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	r.Form = r.URL.Query()
+	for k, v := range obj {
+		r.Form.Set(k, fmt.Sprint(v))
+	}
+	return r.Form, nil
+}
+
+// requireVonageSignature reject webhook requests not signed with VONAGE_SIGNATURE_SECRET with 403.
+// VONAGE_SIGNATURE_METHOD is md5hash (default) or sha256, as set on the Vonage account.
+// Set VONAGE_SKIP_SIGNATURE=true together with GO_ENV=development to bypass the check locally.
+func requireVonageSignature(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if os.Getenv("GO_ENV") == "development" && os.Getenv("VONAGE_SKIP_SIGNATURE") == "true" {
+			next(w, r, ps)
+			return
+		}
+
+		params, err := vonageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !validVonageSignature(params, os.Getenv("VONAGE_SIGNATURE_METHOD"), time.Now()) {
+			log.Println("Rejected unsigned Vonage webhook to", r.URL.Path, "from", r.RemoteAddr)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		next(w, r, ps)
+	}
+}
+
+// validVonageSignature compare the sig param with the hash Vonage computes over every
+// other param sorted by name as &name=value, with & and = in values replaced by _.
+// Signatures older than 5 minutes are rejected so that requests cannot be replayed.
+func validVonageSignature(params url.Values, method string, now time.Time) bool {
+	signature := params.Get("sig")
+	secret := os.Getenv("VONAGE_SIGNATURE_SECRET")
+	if signature == "" || secret == "" {
+		return false
+	}
+
+	timestamp, err := strconv.ParseInt(params.Get("timestamp"), 10, 64)
+	if err != nil || math.Abs(now.Sub(time.Unix(timestamp, 0)).Minutes()) > 5 {
+		return false
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "sig" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	escape := strings.NewReplacer("&", "_", "=", "_")
+	payload := ""
+	for _, k := range keys {
+		payload += "&" + k + "=" + escape.Replace(params.Get(k))
+	}
+
+	var expected string
+	switch method {
+	case "", "md5hash":
+		sum := md5.Sum([]byte(payload + secret))
+		expected = hex.EncodeToString(sum[:])
+	case "sha256":
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		expected = hex.EncodeToString(mac.Sum(nil))
+	default:
+		return false
+	}
+
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// vonageTestTimestamp is when vonageTestParams were signed with the secret "sekrit"
+const vonageTestTimestamp = 1516000000
+const vonageTestMd5Signature = "3f4f2c8eea3c077e883285d6a64a12f9"
+const vonageTestSha256Signature = "604490ae1a369a1c418b8c76f5dbee359ea722247a35a7b7b0640fab46cb168f"
+
+func vonageTestParams(signature string) url.Values {
+	return url.Values{
+		"msisdn":    {"6591234567"},
+		"to":        {"6598765432"},
+		"text":      {"1,2 & a=b"},
+		"messageId": {"0A0000001234"},
+		"timestamp": {"1516000000"},
+		"type":      {"text"},
+		"sig":       {signature},
+	}
+}
+
+func TestValidVonageSignature(t *testing.T) {
+	os.Setenv("VONAGE_SIGNATURE_SECRET", "sekrit")
+	defer os.Unsetenv("VONAGE_SIGNATURE_SECRET")
+
+	signedAt := time.Unix(vonageTestTimestamp, 0)
+	tampered := vonageTestParams(vonageTestMd5Signature)
+	tampered.Set("text", "3")
+	extra := vonageTestParams(vonageTestMd5Signature)
+	extra.Set("keyword", "CANCEL")
+	restamped := vonageTestParams(vonageTestMd5Signature)
+	restamped.Set("timestamp", "1516000060")
+
+	tests := []struct {
+		name   string
+		params url.Values
+		method string
+		now    time.Time
+		want   bool
+	}{
+		{"md5 known good", vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt, true},
+		{"md5 by default", vonageTestParams(vonageTestMd5Signature), "", signedAt, true},
+		{"md5 upper case", vonageTestParams(strings.ToUpper(vonageTestMd5Signature)), "md5hash", signedAt, true},
+		{"sha256 known good", vonageTestParams(vonageTestSha256Signature), "sha256", signedAt, true},
+		{"md5 signature checked as sha256", vonageTestParams(vonageTestMd5Signature), "sha256", signedAt, false},
+		{"unknown method", vonageTestParams(vonageTestMd5Signature), "sha1", signedAt, false},
+		{"tampered param", tampered, "md5hash", signedAt, false},
+		{"added param", extra, "md5hash", signedAt, false},
+		{"tampered timestamp", restamped, "md5hash", signedAt, false},
+		{"tampered signature", vonageTestParams("4f4f2c8eea3c077e883285d6a64a12f9"), "md5hash", signedAt, false},
+		{"no signature", vonageTestParams(""), "md5hash", signedAt, false},
+		{"within 5 minutes after", vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt.Add(4*time.Minute + 59*time.Second), true},
+		{"within 5 minutes before", vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt.Add(-4 * time.Minute), true},
+		{"more than 5 minutes after", vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt.Add(5*time.Minute + time.Second), false},
+		{"more than 5 minutes before", vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt.Add(-6 * time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		if got := validVonageSignature(tt.params, tt.method, tt.now); got != tt.want {
+			t.Errorf("%s: validVonageSignature() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	os.Unsetenv("VONAGE_SIGNATURE_SECRET")
+	if validVonageSignature(vonageTestParams(vonageTestMd5Signature), "md5hash", signedAt) {
+		t.Error("validVonageSignature() accepted a signature without VONAGE_SIGNATURE_SECRET")
+	}
+}
+
+func TestRequireVonageSignature(t *testing.T) {
+	os.Setenv("VONAGE_SIGNATURE_SECRET", "sekrit")
+	defer os.Unsetenv("VONAGE_SIGNATURE_SECRET")
+
+	handled := false
+	handler := requireVonageSignature(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handled = true
+	})
+
+	// signed now so that the request is within the timestamp window
+	fresh := url.Values{"msisdn": {"6591234567"}, "text": {"1"}, "timestamp": {strconv.FormatInt(time.Now().Unix(), 10)}}
+	sum := md5.Sum([]byte("&msisdn=6591234567&text=1&timestamp=" + fresh.Get("timestamp") + "sekrit"))
+	fresh.Set("sig", hex.EncodeToString(sum[:]))
+	freshTampered := url.Values{}
+	for k, v := range fresh {
+		freshTampered[k] = v
+	}
+	freshTampered.Set("text", "2")
+
+	tests := []struct {
+		name     string
+		params   url.Values
+		wantCode int
+	}{
+		{"known good", fresh, 200},
+		{"tampered param", freshTampered, 403},
+		{"stale timestamp", vonageTestParams(vonageTestMd5Signature), 403},
+		{"no signature", vonageTestParams(""), 403},
+	}
+
+	for _, tt := range tests {
+		handled = false
+		r := httptest.NewRequest("GET", "/api/sms/vonage/reply?"+tt.params.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+
+		if w.Code != tt.wantCode || handled != (tt.wantCode == 200) {
+			t.Errorf("%s: responded %d and handled = %v, want %d", tt.name, w.Code, handled, tt.wantCode)
+		}
+	}
+}
+
+func TestVonageGatewaySendRecordsEveryPart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message-count":"2","messages":[
+			{"message-id":"0A00000001","status":"0","message-price":"0.05"},
+			{"message-id":"0A00000002","status":"0","message-price":"0.05"}
+		]}`))
+	}))
+	defer server.Close()
+
+	g := &vonageGateway{baseURL: server.URL}
+	result, err := g.Send("+6591234567", strings.Repeat("a", 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MessageID != "0A00000001" || len(result.PartIDs) != 1 || result.PartIDs[0] != "0A00000002" {
+		t.Errorf("Send() = %s with parts %v, want 0A00000001 with parts [0A00000002]", result.MessageID, result.PartIDs)
+	}
+	if result.Cost < 0.0999 || result.Cost > 0.1001 || result.CostUnit != "EUR" {
+		t.Errorf("Send() cost = %v %s, want 0.1 EUR", result.Cost, result.CostUnit)
+	}
+}
+
+func TestVonageGatewaySendPartlyRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message-count":"2","messages":[
+			{"message-id":"0A00000001","status":"0","message-price":"0.05"},
+			{"status":"1","error-text":"Throttled"}
+		]}`))
+	}))
+	defer server.Close()
+
+	g := &vonageGateway{baseURL: server.URL}
+	result, err := g.Send("+6591234567", strings.Repeat("a", 200))
+	if err == nil || isRetryable(err) {
+		t.Errorf("Send() error = %v, want an error that is not retryable", err)
+	}
+	if result == nil || result.MessageID != "0A00000001" || len(result.PartIDs) != 0 {
+		t.Errorf("Send() = %+v, want the ID of the part sent", result)
+	}
+}